@@ -0,0 +1,317 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// dedupDigestLen is the length, in bytes, of the SHA-256 content digest
+// recorded for a deduplicated data object.
+const dedupDigestLen = sha256.Size
+
+// dedupExtra is appended after a descriptor's normal Extra contents to
+// record the content digest of the data region it points at, which
+// descriptor owns that region, and (on the owner itself) how many
+// descriptors currently reference it. Only descriptors added through
+// AddDeduplicatedObject, or marked by MarkDedupOwner or RewriteAsDuplicate,
+// carry this trailer, as recorded by dedupHasTrailerMask in
+// Descriptor.Reserved.
+type dedupExtra struct {
+	Digest [dedupDigestLen]byte
+
+	// OwnerID is the ID of the descriptor that owns the data region this
+	// descriptor's Fileoff/Filelen point at. For the owner itself,
+	// OwnerID equals its own ID.
+	OwnerID uint32
+
+	// RefCount is the number of descriptors currently referencing this
+	// region. Only meaningful when read from the owner's own trailer.
+	RefCount uint32
+}
+
+// dedupTrailerLen is the number of bytes at the tail of a descriptor's Extra
+// array reserved for a dedupExtra.
+const dedupTrailerLen = dedupDigestLen + 4 + 4
+
+// AddDeduplicatedObject appends a new descriptor of the given datatype whose
+// content is read from r. If an existing descriptor already owns identical
+// bytes (by SHA-256 content digest), the new descriptor's data region points
+// at the existing bytes instead of appending a duplicate copy, and that
+// region's reference count is incremented; otherwise the content is
+// appended as usual and the new descriptor becomes the region's owner. It
+// returns the ID of the new descriptor.
+func (f *FileImage) AddDeduplicatedObject(datatype Datatype, r io.Reader) (uint32, error) {
+	h := sha256.New()
+	data, err := io.ReadAll(io.TeeReader(r, h))
+	if err != nil {
+		return 0, fmt.Errorf("while reading data object: %w", err)
+	}
+
+	var digest [dedupDigestLen]byte
+	copy(digest[:], h.Sum(nil))
+
+	d := Descriptor{Datatype: datatype, Used: true, Reserved: dedupHasTrailerMask}
+
+	if owner, ok := f.findOwnerByDigest(digest); ok {
+		d.Fileoff = owner.Fileoff
+		d.Filelen = owner.Filelen
+
+		id, err := f.appendDescriptorReferencing(d)
+		if err != nil {
+			return 0, fmt.Errorf("while appending referencing descriptor: %w", err)
+		}
+
+		if err := f.setDedupExtra(id, dedupExtra{Digest: digest, OwnerID: owner.GetID()}); err != nil {
+			return 0, fmt.Errorf("while recording content digest: %w", err)
+		}
+
+		ownerDe, _ := dedupExtraOf(owner)
+		if err := f.setDedupExtra(owner.GetID(), dedupExtra{
+			Digest:   ownerDe.Digest,
+			OwnerID:  owner.GetID(),
+			RefCount: ownerDe.RefCount + 1,
+		}); err != nil {
+			return 0, fmt.Errorf("while updating reference count: %w", err)
+		}
+
+		return id, nil
+	}
+
+	id, err := f.appendDataObject(d, data)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.setDescriptorReservedBit(id, dedupOwnerMask); err != nil {
+		return 0, fmt.Errorf("while marking descriptor %d as dedup owner: %w", id, err)
+	}
+	if err := f.setDedupExtra(id, dedupExtra{Digest: digest, OwnerID: id, RefCount: 1}); err != nil {
+		return 0, fmt.Errorf("while recording content digest: %w", err)
+	}
+
+	return id, nil
+}
+
+// DeleteDeduplicatedObject removes the descriptor identified by id and
+// decrements the reference count of the data region it refers to, freeing
+// the region only once the last referring descriptor has been removed. It
+// returns an error, without modifying the image, if id identifies the
+// owning descriptor of a region that other descriptors still reference.
+func (f *FileImage) DeleteDeduplicatedObject(id uint32) error {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return fmt.Errorf("while locating descriptor %d: %w", id, err)
+	}
+
+	de, ok := dedupExtraOf(d)
+	if !ok {
+		return fmt.Errorf("descriptor %d was not added through AddDeduplicatedObject", id)
+	}
+
+	owner, err := f.GetDescriptor(WithID(de.OwnerID))
+	if err != nil {
+		return fmt.Errorf("while locating owning descriptor for %d: %w", id, err)
+	}
+	ownerDe, _ := dedupExtraOf(owner)
+
+	if id == owner.GetID() && ownerDe.RefCount > 1 {
+		return fmt.Errorf("descriptor %d still has %d other reference(s) to its data", id, ownerDe.RefCount-1)
+	}
+
+	if err := f.deleteDescriptor(id); err != nil {
+		return fmt.Errorf("while deleting descriptor %d: %w", id, err)
+	}
+
+	if ownerDe.RefCount <= 1 {
+		return f.freeDataRegion(owner)
+	}
+
+	return f.setDedupExtra(owner.GetID(), dedupExtra{
+		Digest:   ownerDe.Digest,
+		OwnerID:  owner.GetID(),
+		RefCount: ownerDe.RefCount - 1,
+	})
+}
+
+// ErrOverlayNotDedupEligible is returned by MarkDedupOwner when asked to mark
+// an overlay partition, whose data region is explicitly mutable runtime
+// scratch space and must never be aliased.
+var ErrOverlayNotDedupEligible = errors.New("overlay partitions are not eligible for deduplication")
+
+// ErrEncryptedNotDedupEligible is returned by MarkDedupOwner when asked to
+// mark an encrypted partition. An EncryptedPartition's CryptKey extra
+// metadata (Partition plus CryptKey, up to 119 of the 128 Extra bytes) runs
+// into the dedup trailer's fixed 40-byte reservation at the tail of Extra,
+// so recording one would clobber the tail of WrappedDEK and WrappedDEKLen.
+var ErrEncryptedNotDedupEligible = errors.New("encrypted partitions are not eligible for deduplication")
+
+// MarkDedupOwner retroactively marks the existing descriptor identified by
+// id, whose data region was not appended through AddDeduplicatedObject, as
+// the owner of a content-addressed region, hashing its current bytes in
+// place. It is a no-op if id is already marked. It returns the descriptor's
+// hex-encoded content digest, for use with WithContentDigest or
+// RewriteAsDuplicate. It returns ErrOverlayNotDedupEligible if id identifies
+// an overlay partition, and ErrEncryptedNotDedupEligible if id identifies an
+// encrypted partition.
+func (f *FileImage) MarkDedupOwner(id uint32) (string, error) {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return "", fmt.Errorf("while locating descriptor %d: %w", id, err)
+	}
+
+	if overlay, err := WithOverlayPartitions()(d); err != nil {
+		return "", fmt.Errorf("while checking descriptor %d: %w", id, err)
+	} else if overlay {
+		return "", fmt.Errorf("descriptor %d: %w", id, ErrOverlayNotDedupEligible)
+	}
+
+	if encrypted, err := WithEncryptedPartitions()(d); err != nil {
+		return "", fmt.Errorf("while checking descriptor %d: %w", id, err)
+	} else if encrypted {
+		return "", fmt.Errorf("descriptor %d: %w", id, ErrEncryptedNotDedupEligible)
+	}
+
+	if de, ok := dedupExtraOf(d); ok {
+		return hex.EncodeToString(de.Digest[:]), nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f.Fp, d.Fileoff, d.Filelen)); err != nil {
+		return "", fmt.Errorf("while hashing descriptor %d: %w", id, err)
+	}
+
+	var digest [dedupDigestLen]byte
+	copy(digest[:], h.Sum(nil))
+
+	if err := f.setDescriptorReservedBit(id, dedupOwnerMask|dedupHasTrailerMask); err != nil {
+		return "", fmt.Errorf("while marking descriptor %d as dedup owner: %w", id, err)
+	}
+	if err := f.setDedupExtra(id, dedupExtra{Digest: digest, OwnerID: id, RefCount: 1}); err != nil {
+		return "", fmt.Errorf("while recording content digest: %w", err)
+	}
+
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// RewriteAsDuplicate converts the existing descriptor identified by id,
+// whose data region duplicates content already owned by ownerID, into a
+// reference to that region: it frees id's own (now redundant) data region,
+// points id at ownerID's region instead, and increments ownerID's reference
+// count.
+func (f *FileImage) RewriteAsDuplicate(id, ownerID uint32) error {
+	idx, d, err := f.findSlot(id)
+	if err != nil {
+		return err
+	}
+
+	owner, err := f.GetDescriptor(WithID(ownerID))
+	if err != nil {
+		return fmt.Errorf("while locating owning descriptor %d: %w", ownerID, err)
+	}
+	ownerDe, ok := dedupExtraOf(owner)
+	if !ok {
+		return fmt.Errorf("descriptor %d is not a dedup owner", ownerID)
+	}
+
+	old := d
+	d.Fileoff = owner.Fileoff
+	d.Filelen = owner.Filelen
+	d.Reserved |= dedupHasTrailerMask
+
+	if err := f.writeDescriptorAt(idx, d); err != nil {
+		return fmt.Errorf("while rewriting descriptor %d: %w", id, err)
+	}
+
+	if err := f.setDedupExtra(id, dedupExtra{Digest: ownerDe.Digest, OwnerID: ownerID}); err != nil {
+		return fmt.Errorf("while recording content digest: %w", err)
+	}
+	if err := f.setDedupExtra(ownerID, dedupExtra{
+		Digest:   ownerDe.Digest,
+		OwnerID:  ownerID,
+		RefCount: ownerDe.RefCount + 1,
+	}); err != nil {
+		return fmt.Errorf("while updating reference count: %w", err)
+	}
+
+	return f.freeDataRegion(old)
+}
+
+// findOwnerByDigest returns the descriptor that owns the data region
+// recorded under digest, if any. Overlay partitions are never returned as
+// owners: they are explicitly mutable runtime scratch space (see
+// AddOverlay), so aliasing their data region would let a write to one
+// reference silently corrupt every other descriptor pointed at it. Encrypted
+// partitions are never returned either, for the same Extra-layout collision
+// reason documented on ErrEncryptedNotDedupEligible.
+func (f *FileImage) findOwnerByDigest(digest [dedupDigestLen]byte) (Descriptor, bool) {
+	notOverlay := func(d Descriptor) (bool, error) {
+		overlay, err := WithOverlayPartitions()(d)
+		return !overlay, err
+	}
+	notEncrypted := func(d Descriptor) (bool, error) {
+		encrypted, err := WithEncryptedPartitions()(d)
+		return !encrypted, err
+	}
+
+	ds, err := f.GetDescriptors(WithContentDigest(hex.EncodeToString(digest[:])), isDedupOwner, notOverlay, notEncrypted)
+	if err != nil || len(ds) == 0 {
+		return Descriptor{}, false
+	}
+	return ds[0], true
+}
+
+// isDedupOwner is a DescriptorSelectorFunc that selects descriptors that own
+// the content-addressed region they point at.
+func isDedupOwner(d Descriptor) (bool, error) {
+	return d.Reserved&dedupOwnerMask != 0, nil
+}
+
+// WithContentDigest is a DescriptorSelectorFunc that selects descriptors
+// carrying the given hex-encoded SHA-256 content digest, as recorded by
+// AddDeduplicatedObject.
+func WithContentDigest(digest string) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		de, ok := dedupExtraOf(d)
+		if !ok {
+			return false, nil
+		}
+		return hex.EncodeToString(de.Digest[:]) == digest, nil
+	}
+}
+
+// dedupExtraOf decodes the dedup trailer recorded for d, reporting false if
+// d carries none.
+func dedupExtraOf(d Descriptor) (dedupExtra, bool) {
+	if d.Reserved&dedupHasTrailerMask == 0 {
+		return dedupExtra{}, false
+	}
+
+	base := len(d.Extra) - dedupTrailerLen
+
+	var de dedupExtra
+	if err := binary.Read(bytes.NewReader(d.Extra[base:]), binary.LittleEndian, &de); err != nil {
+		return dedupExtra{}, false
+	}
+
+	return de, true
+}
+
+// setDedupExtra persists de into the dedup trailer of the descriptor
+// identified by id.
+func (f *FileImage) setDedupExtra(id uint32, de dedupExtra) error {
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, de); err != nil {
+		return fmt.Errorf("while encoding dedup trailer: %w", err)
+	}
+	return f.writeExtraTrailer(id, b.Bytes())
+}
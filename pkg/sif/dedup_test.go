@@ -0,0 +1,280 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func newTestImage(t *testing.T) *FileImage {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.sif")
+	if err := newContainerFile(path, HdrArchAMD64); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadContainer(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := f.UnloadContainer(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &f
+}
+
+func TestFileImage_AddDeduplicatedObject(t *testing.T) {
+	f := newTestImage(t)
+
+	id1, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id3, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader([]byte("world")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d1, err := f.GetDescriptor(WithID(id1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := f.GetDescriptor(WithID(id2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d3, err := f.GetDescriptor(WithID(id3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := d2.Fileoff, d1.Fileoff; got != want {
+		t.Errorf("duplicate content: got fileoff %v, want %v", got, want)
+	}
+	if got, unwanted := d3.Fileoff, d1.Fileoff; got == unwanted {
+		t.Errorf("distinct content: got fileoff %v, did not want %v", got, unwanted)
+	}
+
+	if err := f.DeleteDeduplicatedObject(id1); err == nil {
+		t.Error("expected an error deleting an owner with a remaining reference")
+	}
+
+	if err := f.DeleteDeduplicatedObject(id2); err != nil {
+		t.Fatalf("while deleting duplicate: %v", err)
+	}
+	if err := f.DeleteDeduplicatedObject(id1); err != nil {
+		t.Fatalf("while deleting now-unreferenced owner: %v", err)
+	}
+}
+
+func TestFileImage_WithContentDigest(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	de, ok := dedupExtraOf(d)
+	if !ok {
+		t.Fatal("expected descriptor to carry a dedup trailer")
+	}
+
+	got, err := f.GetDescriptor(WithContentDigest(hex.EncodeToString(de.Digest[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetID() != id {
+		t.Errorf("got ID %v, want %v", got.GetID(), id)
+	}
+}
+
+func TestFileImage_MarkDedupOwnerAndRewriteAsDuplicate(t *testing.T) {
+	f := newTestImage(t)
+
+	id1, err := f.appendDataObject(Descriptor{Datatype: DataGeneric}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := f.appendDataObject(Descriptor{Datatype: DataGeneric}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := f.MarkDedupOwner(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.RewriteAsDuplicate(id2, id1); err != nil {
+		t.Fatal(err)
+	}
+
+	d1, err := f.GetDescriptor(WithID(id1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := f.GetDescriptor(WithID(id2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := d2.Fileoff, d1.Fileoff; got != want {
+		t.Errorf("got fileoff %v, want %v", got, want)
+	}
+
+	de, ok := dedupExtraOf(d1)
+	if !ok {
+		t.Fatal("expected owner to carry a dedup trailer")
+	}
+	if got, want := de.RefCount, uint32(2); got != want {
+		t.Errorf("got refcount %v, want %v", got, want)
+	}
+	if got, want := hex.EncodeToString(de.Digest[:]), digest; got != want {
+		t.Errorf("got digest %v, want %v", got, want)
+	}
+}
+
+func TestFileImage_MarkDedupOwnerRejectsOverlay(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.MarkDedupOwner(id); !errors.Is(err, ErrOverlayNotDedupEligible) {
+		t.Errorf("got error %v, want %v", err, ErrOverlayNotDedupEligible)
+	}
+}
+
+func TestFileImage_AddDeduplicatedObjectIgnoresOverlayOwner(t *testing.T) {
+	f := newTestImage(t)
+
+	// Two freshly created overlays of the same size are indistinguishable
+	// by content digest (both are zero-filled), but must never be treated
+	// as aliases of one another: they are independently mutable scratch
+	// space.
+	id1, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d1, err := f.GetDescriptor(WithID(id1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := f.GetDescriptor(WithID(id2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.Fileoff == d2.Fileoff {
+		t.Fatalf("overlays unexpectedly share a data region at fileoff %v", d1.Fileoff)
+	}
+
+	// A subsequent AddDeduplicatedObject with matching (zero-filled)
+	// content must not alias onto either overlay's region.
+	id3, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader(make([]byte, 4096)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d3, err := f.GetDescriptor(WithID(id3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d3.Fileoff == d1.Fileoff || d3.Fileoff == d2.Fileoff {
+		t.Errorf("deduplicated object unexpectedly aliased an overlay's data region")
+	}
+}
+
+func TestFileImage_MarkDedupOwnerRejectsEncrypted(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddEncryptedPartition(bytes.NewReader([]byte("squashfs bytes")), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.MarkDedupOwner(id); !errors.Is(err, ErrEncryptedNotDedupEligible) {
+		t.Errorf("got error %v, want %v", err, ErrEncryptedNotDedupEligible)
+	}
+}
+
+func TestFileImage_AddDeduplicatedObjectIgnoresEncryptedOwner(t *testing.T) {
+	f := newTestImage(t)
+
+	key := []byte("correct horse battery staple")
+	plaintext := []byte("squashfs bytes")
+
+	id1, err := f.AddEncryptedPartition(bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err := f.GetDescriptor(WithID(id1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A subsequent AddDeduplicatedObject whose content happens to match the
+	// encrypted partition's ciphertext must not alias onto its data region:
+	// aliasing would collide the dedup trailer with CryptKey's
+	// WrappedDEK/WrappedDEKLen fields in the shared Extra area.
+	ciphertext := make([]byte, d1.Filelen)
+	if _, err := f.Fp.ReadAt(ciphertext, d1.Fileoff); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := f.AddDeduplicatedObject(DataGeneric, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := f.GetDescriptor(WithID(id2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Fileoff == d1.Fileoff {
+		t.Fatalf("deduplicated object unexpectedly aliased an encrypted partition's data region")
+	}
+
+	// The encrypted partition must still decrypt correctly: its Extra area
+	// was never touched by the dedup trailer.
+	rc, err := f.OpenEncryptedPartition(id1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+}
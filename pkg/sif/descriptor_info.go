@@ -0,0 +1,109 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"fmt"
+	"time"
+)
+
+// DescriptorInfo is a serialization-friendly view of a Descriptor, suitable
+// for marshaling to JSON or YAML. Unlike Descriptor itself, enum-like fields
+// are rendered as their string names and Extra is decoded according to
+// Datatype.
+type DescriptorInfo struct {
+	ID       uint32 `json:"id" yaml:"id"`
+	Datatype string `json:"datatype" yaml:"datatype"`
+	Used     bool   `json:"used" yaml:"used"`
+
+	// GroupID is the descriptor's group, or 0 if it belongs to no group.
+	GroupID uint32 `json:"groupId,omitempty" yaml:"groupId,omitempty"`
+
+	// LinkedID is the ID of the descriptor this one is linked to, or 0 if
+	// unlinked.
+	LinkedID uint32 `json:"linkedId,omitempty" yaml:"linkedId,omitempty"`
+
+	Fileoff int64 `json:"fileoff" yaml:"fileoff"`
+	Filelen int64 `json:"filelen" yaml:"filelen"`
+
+	Created  time.Time `json:"created" yaml:"created"`
+	Modified time.Time `json:"modified" yaml:"modified"`
+
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	Partition *PartitionInfo `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Signature *SignatureInfo `json:"signature,omitempty" yaml:"signature,omitempty"`
+}
+
+// PartitionInfo is the human-readable rendering of a Partition extra block.
+type PartitionInfo struct {
+	Fstype   string `json:"fstype" yaml:"fstype"`
+	Parttype string `json:"parttype" yaml:"parttype"`
+	Arch     string `json:"arch" yaml:"arch"`
+}
+
+// SignatureInfo is the human-readable rendering of signature-related extra
+// data.
+type SignatureInfo struct {
+	Format   string `json:"format" yaml:"format"`
+	Hashtype string `json:"hashtype" yaml:"hashtype"`
+}
+
+// GetInfo returns a DescriptorInfo rendering of d.
+func (d Descriptor) GetInfo() (DescriptorInfo, error) {
+	info := DescriptorInfo{
+		ID:       d.GetID(),
+		Datatype: d.Datatype.String(),
+		Used:     d.Used,
+		Fileoff:  d.Fileoff,
+		Filelen:  d.Filelen,
+		Created:  time.Unix(d.Ctime, 0).UTC(),
+		Modified: time.Unix(d.Mtime, 0).UTC(),
+		Name:     cstring(d.Name[:]),
+	}
+
+	if d.Groupid != DescrUnusedGroup {
+		info.GroupID = d.Groupid &^ DescrGroupMask
+	}
+	if d.Link != DescrUnusedLink {
+		info.LinkedID = d.Link &^ DescrGroupMask
+	}
+
+	switch d.Datatype {
+	case DataPartition:
+		var p Partition
+		if err := unmarshalExtra(d, &p); err != nil {
+			return DescriptorInfo{}, fmt.Errorf("while decoding partition metadata: %w", err)
+		}
+		info.Partition = &PartitionInfo{
+			Fstype:   p.Fstype.String(),
+			Parttype: p.Parttype.String(),
+			Arch:     cstring(p.Arch[:]),
+		}
+	case DataSignature:
+		var sh SignatureHeader
+		if err := sh.unmarshal(d); err != nil {
+			return DescriptorInfo{}, fmt.Errorf("while decoding signature metadata: %w", err)
+		}
+		info.Signature = &SignatureInfo{
+			Format:   sh.format(),
+			Hashtype: sh.Hashtype.String(),
+		}
+	}
+
+	return info, nil
+}
+
+// cstring trims a NUL-padded fixed-size byte array down to its string
+// content.
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDescriptor_GetInfoSignature(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.appendDataObject(Descriptor{Datatype: DataGeneric, Used: true}, []byte("payload to sign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &PGPBackend{Entity: entity, KeyRing: openpgp.EntityList{entity}}
+	if err := f.AddSignature(id, backend); err != nil {
+		t.Fatal(err)
+	}
+
+	sigDescr, err := f.GetDescriptor(WithDataType(DataSignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := sigDescr.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Signature == nil {
+		t.Fatal("expected Signature info to be populated")
+	}
+	if got, want := info.Signature.Format, pgpFormat; got != want {
+		t.Errorf("got format %q, want %q", got, want)
+	}
+
+	if _, err := json.Marshal(info); err != nil {
+		t.Errorf("while marshaling to JSON: %v", err)
+	}
+	if _, err := yaml.Marshal(info); err != nil {
+		t.Errorf("while marshaling to YAML: %v", err)
+	}
+}
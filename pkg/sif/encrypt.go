@@ -0,0 +1,392 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFType identifies the key derivation function used to protect a wrapped
+// data encryption key.
+type KDFType uint8
+
+const (
+	// KDFArgon2id derives a key-encryption key from a passphrase using
+	// Argon2id.
+	KDFArgon2id KDFType = iota + 1
+)
+
+// ErrWrongKey is returned by OpenEncryptedPartition when key fails to
+// unwrap the partition's data encryption key.
+var ErrWrongKey = errors.New("incorrect decryption key")
+
+// Argon2idParams holds the KDF parameters used to derive a key-encryption
+// key from a passphrase, mirroring the fields LUKS2 records per key slot.
+type Argon2idParams struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	Salt        [32]byte
+}
+
+// EncryptedPartition is the Extra-area layout for a FsEncryptedSquashfs
+// partition descriptor: the usual Partition metadata, followed by the
+// CryptKey describing how to unwrap its data encryption key.
+type EncryptedPartition struct {
+	Partition
+	CryptKey
+}
+
+// CryptKey is the extra-metadata struct stored alongside an encrypted
+// partition descriptor, describing how its data encryption key (DEK) is
+// wrapped and which KDF protects it.
+type CryptKey struct {
+	KDF KDFType
+
+	Argon2id Argon2idParams
+
+	// WrapNonce is the AES-GCM nonce used when wrapping the data
+	// encryption key under the key-encryption key derived via KDF.
+	WrapNonce [12]byte
+
+	// WrappedDEK is the data encryption key, wrapped (encrypted) under the
+	// key-encryption key derived via KDF. Sized to hold a dekSize key plus
+	// its AES-GCM authentication tag.
+	WrappedDEK [48]byte
+
+	// WrappedDEKLen is the number of meaningful bytes in WrappedDEK.
+	WrappedDEKLen uint8
+}
+
+// dekSize is the length, in bytes, of the randomly generated AES-256 data
+// encryption key wrapped by CryptKey.
+const dekSize = 32
+
+// encryptChunkSize is the amount of plaintext, in bytes, sealed under a
+// single AES-GCM segment. AddEncryptedPartition/OpenEncryptedPartition
+// stream a partition as a sequence of these segments rather than sealing it
+// under one AES-GCM call, so neither side ever holds more than one segment
+// of plaintext or ciphertext in memory at a time.
+const encryptChunkSize = 1 << 20 // 1 MiB
+
+// streamNoncePrefixLen is the length, in bytes, of the random prefix stored
+// at the start of an encrypted partition's data region and combined with a
+// per-segment counter to derive each segment's AES-GCM nonce.
+const streamNoncePrefixLen = 4
+
+// segmentNonce derives the AES-GCM nonce for segment index counter of a
+// stream whose random prefix is noncePrefix: prefix || big-endian counter.
+// Keeping the counter in the low 8 bytes and never reusing it within a
+// stream guarantees nonce uniqueness for the lifetime of the random prefix.
+func segmentNonce(noncePrefix [streamNoncePrefixLen]byte, counter uint64) []byte {
+	nonce := make([]byte, streamNoncePrefixLen+8)
+	copy(nonce, noncePrefix[:])
+	binary.BigEndian.PutUint64(nonce[streamNoncePrefixLen:], counter)
+	return nonce
+}
+
+// encryptOptions holds the configuration assembled from a set of
+// EncryptOption.
+type encryptOptions struct {
+	kdf KDFType
+}
+
+// EncryptOption configures AddEncryptedPartition.
+type EncryptOption func(*encryptOptions) error
+
+// OptKDF selects the key derivation function used to protect the data
+// encryption key.
+func OptKDF(kdf KDFType) EncryptOption {
+	return func(opts *encryptOptions) error {
+		opts.kdf = kdf
+		return nil
+	}
+}
+
+// AddEncryptedPartition reads plaintext from r in encryptChunkSize segments,
+// encrypts each under a freshly generated random data encryption key using
+// AES-256-GCM, and appends it as a new FsEncryptedSquashfs partition
+// descriptor: ciphertext is streamed directly into the SIF data region one
+// segment at a time, so at most one segment of plaintext or ciphertext is
+// ever held in memory. The data encryption key is itself wrapped under a
+// key-encryption key derived from key via the configured KDF, and the
+// wrapped result is recorded in the descriptor's Extra area; key never
+// touches disk directly. It returns the ID of the new descriptor.
+func (f *FileImage) AddEncryptedPartition(r io.Reader, key []byte, opts ...EncryptOption) (uint32, error) {
+	o := &encryptOptions{kdf: KDFArgon2id}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return 0, fmt.Errorf("while applying option: %w", err)
+		}
+	}
+
+	dek := make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return 0, fmt.Errorf("while generating data encryption key: %w", err)
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return 0, fmt.Errorf("while initializing AEAD: %w", err)
+	}
+
+	var noncePrefix [streamNoncePrefixLen]byte
+	if _, err := io.ReadFull(rand.Reader, noncePrefix[:]); err != nil {
+		return 0, fmt.Errorf("while generating stream nonce prefix: %w", err)
+	}
+
+	startOff, err := f.reserveDataRegion(streamNoncePrefixLen)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Fp.WriteAt(noncePrefix[:], startOff); err != nil {
+		return 0, fmt.Errorf("while writing stream nonce prefix: %w", err)
+	}
+	total := int64(streamNoncePrefixLen)
+
+	buf := make([]byte, encryptChunkSize)
+	for counter := uint64(0); ; counter++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("while reading plaintext: %w", readErr)
+		}
+
+		if n > 0 {
+			sealed := gcm.Seal(nil, segmentNonce(noncePrefix, counter), buf[:n], nil)
+
+			off, err := f.reserveDataRegion(int64(len(sealed)))
+			if err != nil {
+				return 0, err
+			}
+			if _, err := f.Fp.WriteAt(sealed, off); err != nil {
+				return 0, fmt.Errorf("while writing ciphertext segment: %w", err)
+			}
+			total += int64(len(sealed))
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	wrappedDEK, err := wrapDEK(dek, key, o.kdf)
+	if err != nil {
+		return 0, fmt.Errorf("while wrapping data encryption key: %w", err)
+	}
+
+	extra, err := marshalExtra(EncryptedPartition{
+		Partition: Partition{
+			Fstype:   FsEncryptedSquashfs,
+			Parttype: PartPrimSys,
+		},
+		CryptKey: wrappedDEK,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("while encoding partition metadata: %w", err)
+	}
+
+	d := Descriptor{
+		Datatype: DataPartition,
+		Used:     true,
+		Extra:    extra,
+	}
+
+	return f.appendDescriptorAt(d, startOff, total)
+}
+
+// wrapDEK derives a key-encryption key from key using kdf and a fresh random
+// salt, then uses it to encrypt (wrap) dek under AES-256-GCM.
+func wrapDEK(dek, key []byte, kdf KDFType) (CryptKey, error) {
+	ck := CryptKey{KDF: kdf}
+
+	if _, err := io.ReadFull(rand.Reader, ck.Argon2id.Salt[:]); err != nil {
+		return CryptKey{}, fmt.Errorf("while generating salt: %w", err)
+	}
+	ck.Argon2id.Memory = 64 * 1024
+	ck.Argon2id.Iterations = 3
+	ck.Argon2id.Parallelism = 4
+
+	kek := deriveKEK(key, ck.Argon2id)
+
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return CryptKey{}, fmt.Errorf("while initializing key-wrap AEAD: %w", err)
+	}
+
+	if _, err := io.ReadFull(rand.Reader, ck.WrapNonce[:gcm.NonceSize()]); err != nil {
+		return CryptKey{}, fmt.Errorf("while generating wrap nonce: %w", err)
+	}
+
+	wrapped := gcm.Seal(nil, ck.WrapNonce[:gcm.NonceSize()], dek, nil)
+	if len(wrapped) > len(ck.WrappedDEK) {
+		return CryptKey{}, fmt.Errorf("wrapped key too large to store")
+	}
+	ck.WrappedDEKLen = uint8(copy(ck.WrappedDEK[:], wrapped))
+
+	return ck, nil
+}
+
+// unwrapDEK reverses wrapDEK, recovering the data encryption key from ck
+// using key. It returns ErrWrongKey if key fails to authenticate the
+// wrapped key.
+func unwrapDEK(ck CryptKey, key []byte) ([]byte, error) {
+	kek := deriveKEK(key, ck.Argon2id)
+
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, fmt.Errorf("while initializing key-wrap AEAD: %w", err)
+	}
+
+	dek, err := gcm.Open(nil, ck.WrapNonce[:gcm.NonceSize()], ck.WrappedDEK[:ck.WrappedDEKLen], nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+
+	return dek, nil
+}
+
+// deriveKEK derives a 32-byte key-encryption key from key using the Argon2id
+// parameters recorded in p.
+func deriveKEK(key []byte, p Argon2idParams) []byte {
+	return argon2.IDKey(key, p.Salt[:], p.Iterations, p.Memory, p.Parallelism, 32)
+}
+
+// newGCM constructs an AES-GCM AEAD over an AES-256 key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// OpenEncryptedPartition returns a reader that streams the decrypted
+// contents of the encrypted partition identified by id, verifying each
+// segment's AES-GCM authentication tag as it is read and never holding more
+// than one segment of ciphertext or plaintext in memory. It returns
+// ErrWrongKey if key fails to authenticate the stored ciphertext.
+func (f *FileImage) OpenEncryptedPartition(id uint32, key []byte) (io.ReadCloser, error) {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return nil, fmt.Errorf("while locating descriptor %d: %w", id, err)
+	}
+
+	var ep EncryptedPartition
+	if err := unmarshalExtra(d, &ep); err != nil {
+		return nil, fmt.Errorf("while reading partition metadata: %w", err)
+	}
+	if ep.Fstype != FsEncryptedSquashfs {
+		return nil, fmt.Errorf("descriptor %d is not an encrypted partition", id)
+	}
+
+	dek, err := unwrapDEK(ep.CryptKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, fmt.Errorf("while initializing AEAD: %w", err)
+	}
+
+	if d.Filelen < streamNoncePrefixLen {
+		return nil, ErrWrongKey
+	}
+
+	var noncePrefix [streamNoncePrefixLen]byte
+	if _, err := io.ReadFull(io.NewSectionReader(f.Fp, d.Fileoff, d.Filelen), noncePrefix[:]); err != nil {
+		return nil, fmt.Errorf("while reading stream nonce prefix: %w", err)
+	}
+
+	return &encryptedPartitionReader{
+		gcm:         gcm,
+		noncePrefix: noncePrefix,
+		ciphertext:  io.NewSectionReader(f.Fp, d.Fileoff+streamNoncePrefixLen, d.Filelen-streamNoncePrefixLen),
+	}, nil
+}
+
+// encryptedPartitionReader streams the plaintext of an encrypted partition
+// one AES-GCM segment (see encryptChunkSize) at a time.
+type encryptedPartitionReader struct {
+	gcm         cipher.AEAD
+	noncePrefix [streamNoncePrefixLen]byte
+	ciphertext  io.Reader
+	counter     uint64
+	plaintext   []byte // decrypted segment bytes not yet returned by Read
+}
+
+// segmentCiphertextLen is the on-disk size of a sealed segment carrying
+// encryptChunkSize bytes of plaintext.
+func (r *encryptedPartitionReader) segmentCiphertextLen() int {
+	return encryptChunkSize + r.gcm.Overhead()
+}
+
+func (r *encryptedPartitionReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		sealed := make([]byte, r.segmentCiphertextLen())
+		n, err := io.ReadFull(r.ciphertext, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("while reading ciphertext segment: %w", err)
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+
+		plaintext, openErr := r.gcm.Open(nil, segmentNonce(r.noncePrefix, r.counter), sealed[:n], nil)
+		if openErr != nil {
+			return 0, ErrWrongKey
+		}
+		r.counter++
+		r.plaintext = plaintext
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *encryptedPartitionReader) Close() error {
+	return nil
+}
+
+// WithEncryptedPartitions is a DescriptorSelectorFunc that selects
+// descriptors for encrypted partitions.
+func WithEncryptedPartitions() DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if d.Datatype != DataPartition {
+			return false, nil
+		}
+		var p Partition
+		if err := unmarshalExtra(d, &p); err != nil {
+			return false, err
+		}
+		return p.Fstype == FsEncryptedSquashfs, nil
+	}
+}
+
+// WithKDF is a DescriptorSelectorFunc that selects encrypted partitions
+// protected by the given KDF.
+func WithKDF(kdf KDFType) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		ok, err := WithEncryptedPartitions()(d)
+		if err != nil || !ok {
+			return false, err
+		}
+		var ep EncryptedPartition
+		if err := unmarshalExtra(d, &ep); err != nil {
+			return false, err
+		}
+		return ep.CryptKey.KDF == kdf, nil
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFileImage_AddEncryptedPartition(t *testing.T) {
+	f := newTestImage(t)
+
+	plaintext := []byte("sensitive squashfs bytes")
+	key := []byte("correct horse battery staple")
+
+	id, err := f.AddEncryptedPartition(bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := f.OpenEncryptedPartition(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+
+	if _, err := f.OpenEncryptedPartition(id, []byte("wrong key")); err != ErrWrongKey {
+		t.Errorf("got error %v, want %v", err, ErrWrongKey)
+	}
+}
+
+// TestFileImage_AddEncryptedPartitionMultiSegment exercises plaintext
+// spanning multiple AES-GCM segments (see encryptChunkSize), including a
+// partial trailing segment, to verify AddEncryptedPartition/
+// OpenEncryptedPartition round-trip correctly across segment boundaries.
+// It does not measure how much memory either side uses.
+func TestFileImage_AddEncryptedPartitionMultiSegment(t *testing.T) {
+	f := newTestImage(t)
+
+	plaintext := make([]byte, 2*encryptChunkSize+123)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	key := []byte("correct horse battery staple")
+
+	id, err := f.AddEncryptedPartition(bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := f.OpenEncryptedPartition(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("round-tripped %d bytes, want %d matching bytes", len(got), len(plaintext))
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// unmarshalExtra decodes the fixed-size Extra area of d into v, which must
+// be a pointer to a fixed-size struct.
+func unmarshalExtra(d Descriptor, v interface{}) error {
+	if err := binary.Read(bytes.NewReader(d.Extra[:]), binary.LittleEndian, v); err != nil {
+		return fmt.Errorf("while decoding descriptor %d extra data: %w", d.GetID(), err)
+	}
+	return nil
+}
+
+// marshalExtra encodes v into a fixed-size Extra array.
+func marshalExtra(v interface{}) ([DescrExtraLen]byte, error) {
+	var extra [DescrExtraLen]byte
+
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+		return extra, fmt.Errorf("while encoding extra data: %w", err)
+	}
+	copy(extra[:], b.Bytes())
+
+	return extra, nil
+}
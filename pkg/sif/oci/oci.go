@@ -0,0 +1,327 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package oci converts SIF images into OCI image layouts, so that a SIF file
+// can be consumed directly by tooling that understands the OCI image format
+// (e.g. registries, containers/image).
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+const (
+	ociLayoutVersion = "1.0.0"
+	blobsDir         = "blobs/sha256"
+
+	// mediaTypeSquashfsLayer and mediaTypeExt3Layer are vendor-specific
+	// media types for layers whose content is a raw squashfs or ext3
+	// filesystem image rather than a tar stream, since SIF partitions are
+	// never packed as tar archives.
+	mediaTypeSquashfsLayer = "application/vnd.sylabs.sif.layer.v1.squashfs"
+	mediaTypeExt3Layer     = "application/vnd.sylabs.sif.layer.v1.ext3"
+)
+
+// options holds the configuration assembled from a set of Option.
+type options struct {
+	labels map[string]string
+}
+
+// Option configures the behavior of ToOCILayout.
+type Option func(*options) error
+
+// WithLabels sets the labels to be carried in the generated image config.
+func WithLabels(labels map[string]string) Option {
+	return func(opts *options) error {
+		opts.labels = labels
+		return nil
+	}
+}
+
+// layerInfo describes a single blob written into the layout.
+type layerInfo struct {
+	diffID    string
+	digest    string
+	size      int64
+	mediaType string
+}
+
+// ToOCILayout walks the descriptor table of fimg, extracting the primary
+// system partition and any overlay partitions, and writes an OCI-compliant
+// image layout rooted at dest. Each extracted partition becomes a single
+// uncompressed OCI layer; a config and manifest referencing those layers are
+// generated and recorded in dest/index.json.
+func ToOCILayout(fimg *sif.FileImage, dest string, opts ...Option) error {
+	o := &options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return fmt.Errorf("while applying option: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, blobsDir), 0o755); err != nil {
+		return fmt.Errorf("while creating layout directories: %w", err)
+	}
+
+	descrs, err := partitionDescriptors(fimg)
+	if err != nil {
+		return fmt.Errorf("while selecting partitions: %w", err)
+	}
+
+	layers := make([]layerInfo, 0, len(descrs))
+	for _, d := range descrs {
+		li, err := writeLayer(fimg, d, dest)
+		if err != nil {
+			return fmt.Errorf("while writing layer for descriptor %d: %w", d.GetID(), err)
+		}
+		layers = append(layers, li)
+	}
+
+	archOpt, err := arch(fimg)
+	if err != nil {
+		return fmt.Errorf("while determining architecture: %w", err)
+	}
+
+	configDigest, configSize, err := writeConfig(dest, archOpt, o.labels, layers)
+	if err != nil {
+		return fmt.Errorf("while writing image config: %w", err)
+	}
+
+	manifestDigest, manifestSize, err := writeManifest(dest, configDigest, configSize, layers)
+	if err != nil {
+		return fmt.Errorf("while writing image manifest: %w", err)
+	}
+
+	if err := writeIndex(dest, manifestDigest, manifestSize); err != nil {
+		return fmt.Errorf("while writing image index: %w", err)
+	}
+
+	return writeOCILayoutFile(dest)
+}
+
+// partitionDescriptors returns the primary system partition descriptor
+// followed by any overlay partition descriptors, in the order they should be
+// stacked as layers.
+func partitionDescriptors(fimg *sif.FileImage) ([]sif.Descriptor, error) {
+	prim, err := fimg.GetDescriptor(sif.WithPartitionType(sif.PartPrimSys))
+	if err != nil {
+		return nil, fmt.Errorf("while locating primary system partition: %w", err)
+	}
+
+	descrs := []sif.Descriptor{prim}
+
+	overlays, err := fimg.GetDescriptors(sif.WithPartitionType(sif.PartOverlay))
+	if err != nil && !errors.Is(err, sif.ErrObjectNotFound) {
+		return nil, fmt.Errorf("while locating overlay partitions: %w", err)
+	}
+
+	return append(descrs, overlays...), nil
+}
+
+// writeLayer streams the contents of d into a new blob under dest, computing
+// its digest and (uncompressed) diff-id as it goes.
+func writeLayer(fimg *sif.FileImage, d sif.Descriptor, dest string) (layerInfo, error) {
+	mediaType, err := layerMediaType(d)
+	if err != nil {
+		return layerInfo{}, err
+	}
+
+	r := io.NewSectionReader(fimg.Fp, d.Fileoff, d.Filelen)
+
+	tmp, err := os.CreateTemp(filepath.Join(dest, blobsDir), "layer-*.tmp")
+	if err != nil {
+		return layerInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return layerInfo{}, fmt.Errorf("while streaming partition data: %w", err)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+
+	if err := tmp.Close(); err != nil {
+		return layerInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dest, blobsDir, digest[len("sha256:"):])); err != nil {
+		return layerInfo{}, fmt.Errorf("while finalizing layer blob: %w", err)
+	}
+
+	// The layer is written uncompressed, so its diff-id matches its digest.
+	return layerInfo{
+		diffID:    digest,
+		digest:    digest,
+		size:      size,
+		mediaType: mediaType,
+	}, nil
+}
+
+// layerMediaType returns the OCI media type that accurately describes d's
+// raw filesystem content, based on its partition's Fstype.
+func layerMediaType(d sif.Descriptor) (string, error) {
+	info, err := d.GetInfo()
+	if err != nil {
+		return "", fmt.Errorf("while reading partition metadata: %w", err)
+	}
+	if info.Partition == nil {
+		return "", fmt.Errorf("descriptor %d is not a partition", d.GetID())
+	}
+
+	switch info.Partition.Fstype {
+	case sif.FsSquash.String():
+		return mediaTypeSquashfsLayer, nil
+	case sif.FsExt3.String():
+		return mediaTypeExt3Layer, nil
+	case sif.FsEncryptedSquashfs.String():
+		return "", fmt.Errorf("descriptor %d is an encrypted partition; decrypt it before converting to an OCI layer", d.GetID())
+	default:
+		return "", fmt.Errorf("unsupported partition filesystem type %v", info.Partition.Fstype)
+	}
+}
+
+// arch maps the SIF header architecture of fimg onto the GOARCH value
+// expected in an OCI image config's platform fields.
+func arch(fimg *sif.FileImage) (string, error) {
+	switch strings.TrimRight(string(fimg.Header.Arch[:sif.HdrArchLen]), "\x00") {
+	case sif.HdrArchAMD64:
+		return "amd64", nil
+	case sif.HdrArch386:
+		return "386", nil
+	case sif.HdrArchARM64:
+		return "arm64", nil
+	case sif.HdrArchARM:
+		return "arm", nil
+	default:
+		return "", fmt.Errorf("unrecognized SIF architecture %q", fimg.Header.Arch)
+	}
+}
+
+// writeConfig marshals and writes an OCI image config blob, returning its
+// digest and size.
+func writeConfig(dest, arch string, labels map[string]string, layers []layerInfo) (string, int64, error) {
+	type rootfs struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	type configFile struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Config       struct {
+			Labels map[string]string `json:"Labels,omitempty"`
+		} `json:"config"`
+		RootFS rootfs `json:"rootfs"`
+	}
+
+	cf := configFile{Architecture: arch, OS: "linux"}
+	cf.Config.Labels = labels
+	for _, l := range layers {
+		cf.RootFS.Type = "layers"
+		cf.RootFS.DiffIDs = append(cf.RootFS.DiffIDs, l.diffID)
+	}
+
+	return writeJSONBlob(dest, cf)
+}
+
+// manifest describes the minimal set of fields ToOCILayout populates in an
+// OCI image manifest.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// descriptor is an OCI content descriptor (distinct from sif.Descriptor).
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+func writeManifest(dest, configDigest string, configSize int64, layers []layerInfo) (string, int64, error) {
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	}
+	for _, l := range layers {
+		m.Layers = append(m.Layers, descriptor{
+			MediaType: l.mediaType,
+			Digest:    l.digest,
+			Size:      l.size,
+		})
+	}
+
+	return writeJSONBlob(dest, m)
+}
+
+func writeIndex(dest, manifestDigest string, manifestSize int64) error {
+	index := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []descriptor `json:"manifests"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests: []descriptor{{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}},
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dest, "index.json"), b, 0o644)
+}
+
+func writeOCILayoutFile(dest string) error {
+	layout := struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}{ImageLayoutVersion: ociLayoutVersion}
+
+	b, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dest, "oci-layout"), b, 0o644)
+}
+
+// writeJSONBlob marshals v, writes it as a content-addressed blob under
+// dest/blobs/sha256, and returns its digest and size.
+func writeJSONBlob(dest string, v interface{}) (string, int64, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	path := filepath.Join(dest, blobsDir, digest[len("sha256:"):])
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return "", 0, err
+	}
+
+	return digest, int64(len(b)), nil
+}
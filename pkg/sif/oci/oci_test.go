@@ -0,0 +1,308 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+// testPartition describes a partition object to be written into a test SIF
+// file by newTestSIF.
+type testPartition struct {
+	parttype sif.PartType
+	fstype   sif.FsType
+	data     []byte
+}
+
+// newTestSIF builds a minimal, valid SIF file at a temporary path with one
+// descriptor per entry in parts, in order, and returns a FileImage loaded
+// from it. There is no exported constructor for a from-scratch container in
+// pkg/sif, so the header and descriptor table are assembled by hand here,
+// mirroring the on-disk layout pkg/sif itself writes.
+func newTestSIF(t *testing.T, arch string, parts []testPartition) sif.FileImage {
+	t.Helper()
+
+	headerSize := int64(binary.Size(sif.Header{}))
+	descrSize := int64(binary.Size(sif.Descriptor{}))
+	descroff := headerSize
+	descrlen := int64(len(parts)) * descrSize
+	dataoff := descroff + descrlen
+
+	descrs := make([]sif.Descriptor, len(parts))
+	off := dataoff
+	for i, p := range parts {
+		extra := sif.Partition{Fstype: p.fstype, Parttype: p.parttype}
+		copy(extra.Arch[:], arch)
+
+		b := new(bytes.Buffer)
+		if err := binary.Write(b, binary.LittleEndian, extra); err != nil {
+			t.Fatal(err)
+		}
+
+		d := sif.Descriptor{
+			Datatype: sif.DataPartition,
+			Used:     true,
+			ID:       uint32(i + 1),
+			Fileoff:  off,
+			Filelen:  int64(len(p.data)),
+		}
+		copy(d.Extra[:], b.Bytes())
+
+		descrs[i] = d
+		off += int64(len(p.data))
+	}
+	datalen := off - dataoff
+
+	hdr := sif.Header{
+		Descroff: descroff,
+		Descrlen: descrlen,
+		Dataoff:  dataoff,
+		Datalen:  datalen,
+	}
+	copy(hdr.Magic[:], sif.HdrMagic)
+	copy(hdr.Arch[:], arch)
+
+	path := filepath.Join(t.TempDir(), "test.sif")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	if err := binary.Write(fp, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range descrs {
+		if err := binary.Write(fp, binary.LittleEndian, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range descrs {
+		if _, err := fp.WriteAt(parts[int(d.ID)-1].data, d.Fileoff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fp.Truncate(dataoff + datalen); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := fimg.UnloadContainer(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return fimg
+}
+
+func readJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("while unmarshaling %v: %v", path, err)
+	}
+}
+
+func TestToOCILayout_LayerOrderingAndDigests(t *testing.T) {
+	primary := []byte("primary squashfs bytes")
+	overlay := []byte("overlay ext3 bytes")
+
+	fimg := newTestSIF(t, sif.HdrArchAMD64, []testPartition{
+		{parttype: sif.PartOverlay, fstype: sif.FsExt3, data: overlay},
+		{parttype: sif.PartPrimSys, fstype: sif.FsSquash, data: primary},
+	})
+
+	dest := t.TempDir()
+	if err := ToOCILayout(&fimg, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	var index struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	readJSON(t, filepath.Join(dest, "index.json"), &index)
+	if got, want := len(index.Manifests), 1; got != want {
+		t.Fatalf("got %d manifests, want %d", got, want)
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+			Size      int64  `json:"size"`
+		} `json:"layers"`
+	}
+	readJSON(t, blobPath(dest, index.Manifests[0].Digest), &manifest)
+
+	if got, want := len(manifest.Layers), 2; got != want {
+		t.Fatalf("got %d layers, want %d", got, want)
+	}
+
+	// The primary system partition must be the base layer, regardless of
+	// descriptor table order, with any overlays stacked above it.
+	wantContent := [][]byte{primary, overlay}
+	wantMediaType := []string{mediaTypeSquashfsLayer, mediaTypeExt3Layer}
+	for i, l := range manifest.Layers {
+		if got, want := l.MediaType, wantMediaType[i]; got != want {
+			t.Errorf("layer %d: got media type %v, want %v", i, got, want)
+		}
+
+		wantDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(wantContent[i]))
+		if got, want := l.Digest, wantDigest; got != want {
+			t.Errorf("layer %d: got digest %v, want %v", i, got, want)
+		}
+		if got, want := l.Size, int64(len(wantContent[i])); got != want {
+			t.Errorf("layer %d: got size %v, want %v", i, got, want)
+		}
+
+		got, err := os.ReadFile(blobPath(dest, l.Digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, wantContent[i]) {
+			t.Errorf("layer %d: blob content does not match partition data", i)
+		}
+	}
+
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	readJSON(t, blobPath(dest, manifest.Config.Digest), &config)
+
+	// Layers are written uncompressed, so each diff-id matches its digest.
+	for i, l := range manifest.Layers {
+		if got, want := config.RootFS.DiffIDs[i], l.Digest; got != want {
+			t.Errorf("diff-id %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	layout, err := os.ReadFile(filepath.Join(dest, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(layout, []byte(ociLayoutVersion)) {
+		t.Errorf("oci-layout missing version %v: %s", ociLayoutVersion, layout)
+	}
+}
+
+func TestToOCILayout_MediaTypePerFstype(t *testing.T) {
+	tests := []struct {
+		name       string
+		fstype     sif.FsType
+		wantErr    bool
+		wantErrMsg string
+		mediaType  string
+	}{
+		{name: "Squashfs", fstype: sif.FsSquash, mediaType: mediaTypeSquashfsLayer},
+		{name: "Ext3", fstype: sif.FsExt3, mediaType: mediaTypeExt3Layer},
+		{name: "EncryptedSquashfs", fstype: sif.FsEncryptedSquashfs, wantErr: true, wantErrMsg: "encrypted partition"},
+		{name: "Raw", fstype: sif.FsRaw, wantErr: true, wantErrMsg: "unsupported partition filesystem type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fimg := newTestSIF(t, sif.HdrArchAMD64, []testPartition{
+				{parttype: sif.PartPrimSys, fstype: tt.fstype, data: []byte("partition bytes")},
+			})
+
+			dest := t.TempDir()
+			err := ToOCILayout(&fimg, dest)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error for an unsupported filesystem type")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("got error %v, want it to contain %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var index struct {
+				Manifests []struct {
+					Digest string `json:"digest"`
+				} `json:"manifests"`
+			}
+			readJSON(t, filepath.Join(dest, "index.json"), &index)
+
+			var manifest struct {
+				Layers []struct {
+					MediaType string `json:"mediaType"`
+				} `json:"layers"`
+			}
+			readJSON(t, blobPath(dest, index.Manifests[0].Digest), &manifest)
+
+			if got, want := manifest.Layers[0].MediaType, tt.mediaType; got != want {
+				t.Errorf("got media type %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestToOCILayout_UnsupportedArch(t *testing.T) {
+	fimg := newTestSIF(t, "mips64", []testPartition{
+		{parttype: sif.PartPrimSys, fstype: sif.FsSquash, data: []byte("primary squashfs bytes")},
+	})
+
+	err := ToOCILayout(&fimg, t.TempDir())
+	if err == nil {
+		t.Fatal("expected an error for an unrecognized SIF architecture")
+	}
+	if !strings.Contains(err.Error(), "unrecognized SIF architecture") {
+		t.Errorf("got error %v, want it to mention the unrecognized architecture", err)
+	}
+}
+
+func TestToOCILayout_NoPrimaryPartition(t *testing.T) {
+	fimg := newTestSIF(t, sif.HdrArchAMD64, []testPartition{
+		{parttype: sif.PartOverlay, fstype: sif.FsExt3, data: []byte("overlay bytes")},
+	})
+
+	err := ToOCILayout(&fimg, t.TempDir())
+	if err == nil {
+		t.Fatal("expected an error when no primary system partition is present")
+	}
+	if !strings.Contains(err.Error(), "primary system partition") {
+		t.Errorf("got error %v, want it to mention the missing primary system partition", err)
+	}
+}
+
+// blobPath returns the path of the content-addressed blob identified by the
+// "sha256:<hex>" digest under dest.
+func blobPath(dest, digest string) string {
+	return filepath.Join(dest, blobsDir, strings.TrimPrefix(digest, "sha256:"))
+}
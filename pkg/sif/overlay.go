@@ -0,0 +1,177 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrOverlaySealed is returned by ResizeOverlay when the target overlay
+// partition has already been sealed.
+var ErrOverlaySealed = errors.New("overlay partition is sealed")
+
+// overlayOptions holds the configuration assembled from a set of
+// OverlayOption.
+type overlayOptions struct {
+	groupID uint32
+}
+
+// OverlayOption configures the behavior of AddOverlay.
+type OverlayOption func(*overlayOptions) error
+
+// OptOverlayGroupID links the new overlay partition to the group identified
+// by groupID. AddOverlay returns an error unless that group contains a
+// primary system partition.
+func OptOverlayGroupID(groupID uint32) OverlayOption {
+	return func(opts *overlayOptions) error {
+		if groupID == 0 {
+			return fmt.Errorf("%w", ErrInvalidGroupID)
+		}
+		opts.groupID = groupID
+		return nil
+	}
+}
+
+// AddOverlay creates a new overlay partition of the given FsType and size
+// (in bytes), grows the SIF file in place to hold it, and appends a
+// descriptor for it with Parttype set to PartOverlay. It returns the ID of
+// the newly created descriptor.
+func (f *FileImage) AddOverlay(size int64, fstype FsType, opts ...OverlayOption) (uint32, error) {
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid overlay size %d", size)
+	}
+
+	o := &overlayOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return 0, fmt.Errorf("while applying option: %w", err)
+		}
+	}
+
+	if o.groupID != 0 {
+		if _, err := f.GetDescriptor(WithGroupID(o.groupID), WithPartitionType(PartPrimSys)); err != nil {
+			return 0, fmt.Errorf("while validating group linkage: %w", err)
+		}
+	}
+
+	extra := Partition{
+		Fstype:   fstype,
+		Parttype: PartOverlay,
+	}
+	copy(extra.Arch[:], f.Header.Arch[:])
+
+	return f.addOverlayPartition(size, extra, o.groupID)
+}
+
+// ResizeOverlay grows or shrinks the overlay partition identified by id to
+// newSize bytes by copying as many of its bytes as fit into a freshly
+// reserved region at the end of the data area and rewriting its descriptor
+// to point there. The old region is neither zeroed nor reclaimed. It returns
+// ErrOverlaySealed if the overlay has already been sealed.
+func (f *FileImage) ResizeOverlay(id uint32, newSize int64) error {
+	if newSize <= 0 {
+		return fmt.Errorf("invalid overlay size %d", newSize)
+	}
+
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return fmt.Errorf("while locating overlay partition %d: %w", id, err)
+	}
+
+	if err := requireOverlay(d); err != nil {
+		return err
+	}
+
+	if f.overlaySealed(d) {
+		return fmt.Errorf("partition %d: %w", id, ErrOverlaySealed)
+	}
+
+	return f.resizeDataRegion(d, newSize)
+}
+
+// SealOverlay marks the overlay partition identified by id as immutable,
+// preventing further resizing. Sealed overlays may still be referenced by
+// new descriptors in the same group (e.g. signatures).
+func (f *FileImage) SealOverlay(id uint32) error {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return fmt.Errorf("while locating overlay partition %d: %w", id, err)
+	}
+
+	if err := requireOverlay(d); err != nil {
+		return err
+	}
+
+	return f.setOverlaySealed(d)
+}
+
+// requireOverlay returns an error if d does not describe an overlay
+// partition.
+func requireOverlay(d Descriptor) error {
+	if d.Datatype != DataPartition {
+		return fmt.Errorf("descriptor %d is not a partition", d.GetID())
+	}
+
+	var p Partition
+	if err := binary.Read(bytes.NewReader(d.Extra[:]), binary.LittleEndian, &p); err != nil {
+		return fmt.Errorf("while reading partition metadata: %w", err)
+	}
+	if p.Parttype != PartOverlay {
+		return fmt.Errorf("descriptor %d is not an overlay partition", d.GetID())
+	}
+
+	return nil
+}
+
+// WithOverlayPartitions is a DescriptorSelectorFunc that selects descriptors
+// for overlay partitions.
+func WithOverlayPartitions() DescriptorSelectorFunc {
+	return WithPartitionType(PartOverlay)
+}
+
+// addOverlayPartition grows the backing file by size bytes, appends a new
+// descriptor describing the reserved region, and links it to groupID when
+// non-zero.
+func (f *FileImage) addOverlayPartition(size int64, extra Partition, groupID uint32) (uint32, error) {
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, extra); err != nil {
+		return 0, fmt.Errorf("while encoding partition metadata: %w", err)
+	}
+
+	d := Descriptor{
+		Datatype: DataPartition,
+		Used:     true,
+		Filelen:  size,
+	}
+	copy(d.Extra[:], b.Bytes())
+
+	if groupID != 0 {
+		d.Groupid = groupID | DescrGroupMask
+	}
+
+	return f.growAndAppendDescriptor(d)
+}
+
+// resizeDataRegion changes the data region backing d to newSize bytes.
+func (f *FileImage) resizeDataRegion(d Descriptor, newSize int64) error {
+	if newSize == d.Filelen {
+		return nil
+	}
+	return f.rewriteDescriptorLength(d.GetID(), newSize)
+}
+
+// overlaySealed reports whether d's overlay has been sealed.
+func (f *FileImage) overlaySealed(d Descriptor) bool {
+	return d.Reserved&overlaySealedMask != 0
+}
+
+// setOverlaySealed marks d's overlay as sealed.
+func (f *FileImage) setOverlaySealed(d Descriptor) error {
+	return f.setDescriptorReservedBit(d.GetID(), overlaySealedMask)
+}
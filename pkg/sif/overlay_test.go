@@ -0,0 +1,210 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestFileImage_AddOverlay(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Filelen, int64(4096); got != want {
+		t.Errorf("got filelen %v, want %v", got, want)
+	}
+
+	var p Partition
+	if err := unmarshalExtra(d, &p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Parttype, PartOverlay; got != want {
+		t.Errorf("got parttype %v, want %v", got, want)
+	}
+}
+
+func TestFileImage_AddOverlayGroupLinkage(t *testing.T) {
+	f := newTestImage(t)
+
+	primID, err := f.appendDataObject(Descriptor{Datatype: DataGeneric}, []byte("primary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const groupID = 1
+
+	if _, err := f.AddOverlay(4096, FsSquash, OptOverlayGroupID(groupID)); err == nil {
+		t.Fatal("expected an error linking to a nonexistent group")
+	}
+
+	idx, d, err := f.findSlot(primID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Groupid = groupID | DescrGroupMask
+	if err := f.writeDescriptorAt(idx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.AddOverlay(4096, FsSquash, OptOverlayGroupID(groupID)); err == nil {
+		t.Fatal("expected an error linking to a group with no primary system partition")
+	}
+
+	extra := Partition{Fstype: FsSquash, Parttype: PartPrimSys}
+	copy(extra.Arch[:], f.Header.Arch[:])
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, extra); err != nil {
+		t.Fatal(err)
+	}
+	primPart := Descriptor{Datatype: DataPartition, Groupid: groupID | DescrGroupMask}
+	copy(primPart.Extra[:], b.Bytes())
+	if _, err := f.appendDataObject(primPart, []byte("squashfs")); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.AddOverlay(4096, FsSquash, OptOverlayGroupID(groupID))
+	if err != nil {
+		t.Fatalf("while linking to a group with a primary system partition: %v", err)
+	}
+
+	overlay, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := overlay.Groupid, uint32(groupID)|DescrGroupMask; got != want {
+		t.Errorf("got group ID %v, want %v", got, want)
+	}
+}
+
+func TestFileImage_AddOverlayInvalidGroupID(t *testing.T) {
+	f := newTestImage(t)
+
+	if _, err := f.AddOverlay(4096, FsSquash, OptOverlayGroupID(0)); !errors.Is(err, ErrInvalidGroupID) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidGroupID)
+	}
+}
+
+func TestFileImage_SealOverlay(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.SealOverlay(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.ResizeOverlay(id, 8192); !errors.Is(err, ErrOverlaySealed) {
+		t.Errorf("got error %v, want %v", err, ErrOverlaySealed)
+	}
+}
+
+func TestFileImage_ResizeOverlay(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddOverlay(16, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := []byte("0123456789abcdef")
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Fp.WriteAt(original, d.Fileoff); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.ResizeOverlay(id, 32); err != nil {
+		t.Fatalf("while growing: %v", err)
+	}
+
+	d, err = f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Filelen, int64(32); got != want {
+		t.Errorf("got filelen %v, want %v", got, want)
+	}
+
+	grown := make([]byte, 32)
+	if _, err := f.Fp.ReadAt(grown, d.Fileoff); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(grown[:len(original)], original) {
+		t.Errorf("growing overlay lost original data: got %q, want prefix %q", grown, original)
+	}
+
+	if err := f.ResizeOverlay(id, 8); err != nil {
+		t.Fatalf("while shrinking: %v", err)
+	}
+
+	d, err = f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Filelen, int64(8); got != want {
+		t.Errorf("got filelen %v, want %v", got, want)
+	}
+
+	shrunk := make([]byte, 8)
+	if _, err := f.Fp.ReadAt(shrunk, d.Fileoff); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(shrunk, original[:8]) {
+		t.Errorf("shrinking overlay corrupted retained data: got %q, want %q", shrunk, original[:8])
+	}
+}
+
+func TestFileImage_ResizeOverlayInvalidSize(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.AddOverlay(4096, FsSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.ResizeOverlay(id, -10); err == nil {
+		t.Fatal("expected an error resizing to a negative size")
+	}
+	if err := f.ResizeOverlay(id, 0); err == nil {
+		t.Fatal("expected an error resizing to a zero size")
+	}
+
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Filelen, int64(4096); got != want {
+		t.Errorf("got filelen %v, want %v", got, want)
+	}
+}
+
+func TestFileImage_ResizeOverlayNotOverlay(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.appendDataObject(Descriptor{Datatype: DataGeneric}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.ResizeOverlay(id, 32); err == nil {
+		t.Error("expected an error resizing a non-overlay descriptor")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import "fmt"
+
+// DescriptorSelectorFunc returns true if d matches the criteria encoded by
+// the func, or an error if the criteria could not be evaluated (e.g. an
+// invalid argument was supplied when the selector was constructed).
+type DescriptorSelectorFunc func(d Descriptor) (bool, error)
+
+// WithDataType returns a DescriptorSelectorFunc that selects descriptors
+// with the given Datatype.
+func WithDataType(dt Datatype) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		return d.Datatype == dt, nil
+	}
+}
+
+// WithID returns a DescriptorSelectorFunc that selects the descriptor with
+// the given ID.
+func WithID(id uint32) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if id == 0 {
+			return false, ErrInvalidObjectID
+		}
+		return d.ID == id, nil
+	}
+}
+
+// WithGroupID returns a DescriptorSelectorFunc that selects descriptors
+// belonging to the given group.
+func WithGroupID(groupID uint32) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if groupID == 0 {
+			return false, ErrInvalidGroupID
+		}
+		return d.Groupid == groupID|DescrGroupMask, nil
+	}
+}
+
+// WithNoGroup returns a DescriptorSelectorFunc that selects descriptors
+// belonging to no group.
+func WithNoGroup() DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		return d.Groupid == DescrUnusedGroup, nil
+	}
+}
+
+// WithLinkedID returns a DescriptorSelectorFunc that selects descriptors
+// linked to the object identified by id.
+func WithLinkedID(id uint32) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if id == 0 {
+			return false, ErrInvalidObjectID
+		}
+		return d.Link == id, nil
+	}
+}
+
+// WithLinkedGroupID returns a DescriptorSelectorFunc that selects
+// descriptors linked to the group identified by groupID.
+func WithLinkedGroupID(groupID uint32) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if groupID == 0 {
+			return false, ErrInvalidGroupID
+		}
+		return d.Link == groupID|DescrGroupMask, nil
+	}
+}
+
+// WithPartitionType returns a DescriptorSelectorFunc that selects
+// DataPartition descriptors whose Extra metadata records the given
+// PartType.
+func WithPartitionType(pt PartType) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if d.Datatype != DataPartition {
+			return false, nil
+		}
+		var p Partition
+		if err := unmarshalExtra(d, &p); err != nil {
+			return false, err
+		}
+		return p.Parttype == pt, nil
+	}
+}
+
+// selectDescriptors returns the Used descriptors in f that match every fn in
+// fns.
+func (f *FileImage) selectDescriptors(fns ...DescriptorSelectorFunc) ([]Descriptor, error) {
+	var matches []Descriptor
+
+	for _, d := range f.descrArr {
+		if !d.Used {
+			continue
+		}
+
+		all := true
+		for _, fn := range fns {
+			ok, err := fn(d)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			matches = append(matches, d)
+		}
+	}
+
+	return matches, nil
+}
+
+// GetDescriptors returns every descriptor in f matching all of fns.
+func (f *FileImage) GetDescriptors(fns ...DescriptorSelectorFunc) ([]Descriptor, error) {
+	return f.selectDescriptors(fns...)
+}
+
+// GetDescriptor returns the single descriptor in f matching all of fns. It
+// returns ErrObjectNotFound if no descriptor matches, or
+// ErrMultipleObjectsFound if more than one does.
+func (f *FileImage) GetDescriptor(fns ...DescriptorSelectorFunc) (Descriptor, error) {
+	ds, err := f.selectDescriptors(fns...)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	switch len(ds) {
+	case 0:
+		return Descriptor{}, ErrObjectNotFound
+	case 1:
+		return ds[0], nil
+	default:
+		return Descriptor{}, fmt.Errorf("%d objects: %w", len(ds), ErrMultipleObjectsFound)
+	}
+}
+
+// WithDescriptors calls fn for each Used descriptor in f, in table order,
+// stopping early if fn returns true.
+func (f *FileImage) WithDescriptors(fn func(d Descriptor) bool) {
+	for _, d := range f.descrArr {
+		if !d.Used {
+			continue
+		}
+		if fn(d) {
+			return
+		}
+	}
+}
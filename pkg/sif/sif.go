@@ -0,0 +1,585 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package sif implements data structures and routines to create and access
+// SIF (Singularity Image Format) files.
+package sif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Fixed-size field lengths used throughout the on-disk format.
+const (
+	HdrMagic    = "SIF_MAGIC"
+	HdrArchLen  = 8
+	DescrNameLen  = 128
+	DescrExtraLen = 128
+
+	// maxDescriptors bounds the number of descriptor slots reserved in a
+	// container created by this package.
+	maxDescriptors = 4096
+)
+
+// Architecture codes recorded in Header.Arch and Partition.Arch.
+const (
+	HdrArch386   = "386"
+	HdrArchAMD64 = "amd64"
+	HdrArchARM   = "arm"
+	HdrArchARM64 = "arm64"
+)
+
+// Header is the fixed-size block at the start of every SIF file, describing
+// the container as a whole and locating its descriptor table and data
+// region.
+type Header struct {
+	Magic   [10]byte
+	Version [3]byte
+	Arch    [HdrArchLen]byte
+	ID      [16]byte
+
+	Ctime int64
+	Mtime int64
+
+	// Descroff and Descrlen locate the descriptor table.
+	Descroff int64
+	Descrlen int64
+
+	// Dataoff is the start of the data region; Datalen is the number of
+	// bytes of it currently in use. The next free offset is
+	// Dataoff+Datalen.
+	Dataoff int64
+	Datalen int64
+}
+
+// Datatype identifies the kind of content a Descriptor's data object holds.
+type Datatype int32
+
+const (
+	DataPartition Datatype = iota + 1
+	DataSignature
+	DataGeneric
+	DataCryptoMessage
+)
+
+// String implements fmt.Stringer.
+func (t Datatype) String() string {
+	switch t {
+	case DataPartition:
+		return "Partition"
+	case DataSignature:
+		return "Signature"
+	case DataGeneric:
+		return "Generic"
+	case DataCryptoMessage:
+		return "CryptoMessage"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int32(t))
+	}
+}
+
+// FsType identifies the filesystem format of a partition data object.
+type FsType int32
+
+const (
+	FsSquash FsType = iota + 1
+	FsExt3
+	FsEncryptedSquashfs
+	FsRaw
+)
+
+// String implements fmt.Stringer.
+func (t FsType) String() string {
+	switch t {
+	case FsSquash:
+		return "Squashfs"
+	case FsExt3:
+		return "Ext3"
+	case FsEncryptedSquashfs:
+		return "EncryptedSquashfs"
+	case FsRaw:
+		return "Raw"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int32(t))
+	}
+}
+
+// PartType identifies the role a partition data object plays within the
+// container.
+type PartType int32
+
+const (
+	PartPrimSys PartType = iota + 1
+	PartOverlay
+	PartData
+)
+
+// String implements fmt.Stringer.
+func (t PartType) String() string {
+	switch t {
+	case PartPrimSys:
+		return "System"
+	case PartOverlay:
+		return "Overlay"
+	case PartData:
+		return "Data"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int32(t))
+	}
+}
+
+// Hashtype identifies the hash algorithm applied to a signed payload prior
+// to signing.
+type Hashtype int32
+
+const (
+	HashSHA256 Hashtype = iota + 1
+	HashSHA384
+	HashSHA512
+)
+
+// String implements fmt.Stringer.
+func (h Hashtype) String() string {
+	switch h {
+	case HashSHA256:
+		return "SHA256"
+	case HashSHA384:
+		return "SHA384"
+	case HashSHA512:
+		return "SHA512"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int32(h))
+	}
+}
+
+// Partition is the Extra-area layout for a DataPartition descriptor.
+type Partition struct {
+	Fstype   FsType
+	Parttype PartType
+	Arch     [HdrArchLen]byte
+}
+
+// Reserved bits recorded in Descriptor.Reserved by features built on top of
+// the core descriptor table.
+const (
+	// overlaySealedMask marks an overlay partition as sealed (see
+	// SealOverlay).
+	overlaySealedMask uint32 = 1 << 0
+
+	// dedupHasTrailerMask marks a descriptor as carrying a dedup trailer
+	// in its Extra area (see AddDeduplicatedObject).
+	dedupHasTrailerMask uint32 = 1 << 1
+
+	// dedupOwnerMask marks a descriptor as the owner of a
+	// content-addressed data region (see AddDeduplicatedObject).
+	dedupOwnerMask uint32 = 1 << 2
+)
+
+// Descriptor describes a single data object stored in a SIF file: its type,
+// group/link relationships, and the location of its bytes in the data
+// region.
+type Descriptor struct {
+	Datatype Datatype
+	Used     bool
+	ID       uint32
+	Groupid  uint32
+	Link     uint32
+
+	Fileoff int64
+	Filelen int64
+
+	Ctime int64
+	Mtime int64
+
+	// Reserved carries feature-specific flag bits; see the *Mask
+	// constants above.
+	Reserved uint32
+
+	Name  [DescrNameLen]byte
+	Extra [DescrExtraLen]byte
+}
+
+// GetID returns d's descriptor ID.
+func (d Descriptor) GetID() uint32 {
+	return d.ID
+}
+
+// Sentinel values for Descriptor.Groupid and Descriptor.Link.
+const (
+	// DescrGroupMask is set on a Groupid or Link value to mark it as a
+	// group reference rather than a plain object ID.
+	DescrGroupMask uint32 = 1 << 31
+
+	DescrUnusedGroup uint32 = 0
+	DescrUnusedLink  uint32 = 0
+)
+
+// Errors returned while locating descriptors.
+var (
+	ErrInvalidObjectID     = errors.New("invalid object ID")
+	ErrInvalidGroupID      = errors.New("invalid group ID")
+	ErrObjectNotFound      = errors.New("object not found")
+	ErrMultipleObjectsFound = errors.New("multiple objects found")
+)
+
+var descriptorSize = binary.Size(Descriptor{})
+
+// FileImage is an in-memory representation of a SIF container backed by an
+// open file.
+type FileImage struct {
+	Header Header
+	Fp     *os.File
+
+	descrArr []Descriptor
+	nextID   uint32
+}
+
+// newContainerFile creates a new, empty SIF container at path, with a
+// descriptor table large enough for maxDescriptors objects.
+func newContainerFile(path string, arch string) error {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("while creating container: %w", err)
+	}
+	defer fp.Close()
+
+	descrlen := int64(maxDescriptors) * int64(descriptorSize)
+
+	hdr := Header{
+		Descroff: int64(binary.Size(Header{})),
+		Descrlen: descrlen,
+	}
+	hdr.Dataoff = hdr.Descroff + hdr.Descrlen
+	copy(hdr.Magic[:], HdrMagic)
+	copy(hdr.Arch[:], arch)
+
+	if err := binary.Write(fp, binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("while writing header: %w", err)
+	}
+
+	if err := fp.Truncate(hdr.Dataoff); err != nil {
+		return fmt.Errorf("while allocating descriptor table: %w", err)
+	}
+
+	return nil
+}
+
+// LoadContainer opens the SIF file at path, optionally read-only, and loads
+// its header and descriptor table into memory.
+func LoadContainer(path string, ro bool) (FileImage, error) {
+	flag := os.O_RDWR
+	if ro {
+		flag = os.O_RDONLY
+	}
+
+	fp, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return FileImage{}, fmt.Errorf("while opening container: %w", err)
+	}
+
+	f, err := loadFrom(fp)
+	if err != nil {
+		fp.Close()
+		return FileImage{}, err
+	}
+
+	return f, nil
+}
+
+func loadFrom(fp *os.File) (FileImage, error) {
+	var hdr Header
+	if err := binary.Read(fp, binary.LittleEndian, &hdr); err != nil {
+		return FileImage{}, fmt.Errorf("while reading header: %w", err)
+	}
+	if string(bytes.TrimRight(hdr.Magic[:], "\x00")) != HdrMagic {
+		return FileImage{}, errors.New("not a SIF file")
+	}
+
+	n := hdr.Descrlen / int64(descriptorSize)
+	buf := make([]byte, hdr.Descrlen)
+	if _, err := fp.ReadAt(buf, hdr.Descroff); err != nil {
+		return FileImage{}, fmt.Errorf("while reading descriptor table: %w", err)
+	}
+
+	descrArr := make([]Descriptor, n)
+	var nextID uint32
+	for i := range descrArr {
+		d, err := decodeDescriptor(buf[i*descriptorSize : (i+1)*descriptorSize])
+		if err != nil {
+			return FileImage{}, fmt.Errorf("while decoding descriptor %d: %w", i, err)
+		}
+		descrArr[i] = d
+		if d.ID >= nextID {
+			nextID = d.ID + 1
+		}
+	}
+
+	return FileImage{Header: hdr, Fp: fp, descrArr: descrArr, nextID: nextID}, nil
+}
+
+// UnloadContainer closes the file backing f.
+func (f *FileImage) UnloadContainer() error {
+	if f.Fp == nil {
+		return nil
+	}
+	return f.Fp.Close()
+}
+
+// FmtDescrInfo renders a human-readable summary of the descriptor
+// identified by id.
+func (f *FileImage) FmtDescrInfo(id uint32) string {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return fmt.Sprintf("error: %s\n", err)
+	}
+
+	return fmt.Sprintf(
+		"Descriptor %d:\n  Datatype: %s\n  Used: %t\n  Groupid: %d\n  Link: %d\n  Fileoff: %d\n  Filelen: %d\n",
+		d.ID, d.Datatype, d.Used, d.Groupid, d.Link, d.Fileoff, d.Filelen,
+	)
+}
+
+func encodeDescriptor(d Descriptor) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeDescriptor(b []byte) (Descriptor, error) {
+	var d Descriptor
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &d); err != nil {
+		return Descriptor{}, err
+	}
+	return d, nil
+}
+
+// writeHeader persists f.Header to disk.
+func (f *FileImage) writeHeader() error {
+	b := new(bytes.Buffer)
+	if err := binary.Write(b, binary.LittleEndian, f.Header); err != nil {
+		return err
+	}
+	_, err := f.Fp.WriteAt(b.Bytes(), 0)
+	return err
+}
+
+// writeDescriptorAt persists d as the descriptor table entry at idx, both on
+// disk and in f.descrArr.
+func (f *FileImage) writeDescriptorAt(idx int, d Descriptor) error {
+	b, err := encodeDescriptor(d)
+	if err != nil {
+		return err
+	}
+
+	off := f.Header.Descroff + int64(idx)*int64(descriptorSize)
+	if _, err := f.Fp.WriteAt(b, off); err != nil {
+		return err
+	}
+
+	f.descrArr[idx] = d
+
+	return nil
+}
+
+// findSlot returns the table index and current value of the descriptor
+// identified by id.
+func (f *FileImage) findSlot(id uint32) (int, Descriptor, error) {
+	for i, d := range f.descrArr {
+		if d.Used && d.ID == id {
+			return i, d, nil
+		}
+	}
+	return 0, Descriptor{}, fmt.Errorf("descriptor %d: %w", id, ErrObjectNotFound)
+}
+
+// freeSlot returns the index of an unused descriptor table entry.
+func (f *FileImage) freeSlot() (int, error) {
+	for i, d := range f.descrArr {
+		if !d.Used {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("descriptor table is full (max %d objects)", maxDescriptors)
+}
+
+// nextDescriptorID allocates the next unused descriptor ID.
+func (f *FileImage) nextDescriptorID() uint32 {
+	id := f.nextID
+	f.nextID++
+	return id
+}
+
+// reserveDataRegion grows the container's data region by size bytes and
+// returns the offset of the newly reserved space.
+func (f *FileImage) reserveDataRegion(size int64) (int64, error) {
+	off := f.Header.Dataoff + f.Header.Datalen
+
+	if err := f.Fp.Truncate(off + size); err != nil {
+		return 0, fmt.Errorf("while growing container: %w", err)
+	}
+
+	f.Header.Datalen += size
+	if err := f.writeHeader(); err != nil {
+		return 0, fmt.Errorf("while updating header: %w", err)
+	}
+
+	return off, nil
+}
+
+// appendDescriptorAt allocates a descriptor table slot and ID for d, points
+// it at [off, off+length), and persists it.
+func (f *FileImage) appendDescriptorAt(d Descriptor, off, length int64) (uint32, error) {
+	idx, err := f.freeSlot()
+	if err != nil {
+		return 0, err
+	}
+
+	d.ID = f.nextDescriptorID()
+	d.Used = true
+	d.Fileoff = off
+	d.Filelen = length
+
+	if err := f.writeDescriptorAt(idx, d); err != nil {
+		return 0, fmt.Errorf("while writing descriptor: %w", err)
+	}
+
+	return d.ID, nil
+}
+
+// growAndAppendDescriptor reserves a new, zero-filled data region of
+// d.Filelen bytes and appends d as a descriptor pointing at it.
+func (f *FileImage) growAndAppendDescriptor(d Descriptor) (uint32, error) {
+	off, err := f.reserveDataRegion(d.Filelen)
+	if err != nil {
+		return 0, err
+	}
+	return f.appendDescriptorAt(d, off, d.Filelen)
+}
+
+// appendDataObject reserves a new data region, writes data into it, and
+// appends d as a descriptor pointing at it.
+func (f *FileImage) appendDataObject(d Descriptor, data []byte) (uint32, error) {
+	off, err := f.reserveDataRegion(int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Fp.WriteAt(data, off); err != nil {
+		return 0, fmt.Errorf("while writing data object: %w", err)
+	}
+
+	return f.appendDescriptorAt(d, off, int64(len(data)))
+}
+
+// appendDescriptorReferencing allocates a descriptor table slot and ID for
+// d without reserving any new data region; d.Fileoff/d.Filelen must already
+// describe an existing region.
+func (f *FileImage) appendDescriptorReferencing(d Descriptor) (uint32, error) {
+	idx, err := f.freeSlot()
+	if err != nil {
+		return 0, err
+	}
+
+	d.ID = f.nextDescriptorID()
+	d.Used = true
+
+	if err := f.writeDescriptorAt(idx, d); err != nil {
+		return 0, fmt.Errorf("while writing descriptor: %w", err)
+	}
+
+	return d.ID, nil
+}
+
+// rewriteDescriptorLength relocates the data region backing the descriptor
+// identified by id to a freshly reserved region of newSize bytes,
+// preserving as many of the original bytes as fit.
+func (f *FileImage) rewriteDescriptorLength(id uint32, newSize int64) error {
+	idx, d, err := f.findSlot(id)
+	if err != nil {
+		return err
+	}
+
+	newOff, err := f.reserveDataRegion(newSize)
+	if err != nil {
+		return err
+	}
+
+	toCopy := d.Filelen
+	if newSize < toCopy {
+		toCopy = newSize
+	}
+	if toCopy > 0 {
+		buf := make([]byte, toCopy)
+		if _, err := f.Fp.ReadAt(buf, d.Fileoff); err != nil {
+			return fmt.Errorf("while reading existing data: %w", err)
+		}
+		if _, err := f.Fp.WriteAt(buf, newOff); err != nil {
+			return fmt.Errorf("while writing relocated data: %w", err)
+		}
+	}
+
+	d.Fileoff = newOff
+	d.Filelen = newSize
+
+	return f.writeDescriptorAt(idx, d)
+}
+
+// setDescriptorReservedBit sets the bits of mask in the Reserved field of
+// the descriptor identified by id.
+func (f *FileImage) setDescriptorReservedBit(id uint32, mask uint32) error {
+	idx, d, err := f.findSlot(id)
+	if err != nil {
+		return err
+	}
+	d.Reserved |= mask
+	return f.writeDescriptorAt(idx, d)
+}
+
+// deleteDescriptor marks the descriptor identified by id as unused, freeing
+// its table slot for reuse. The underlying data region is left untouched;
+// callers that need to reclaim it should call freeDataRegion.
+func (f *FileImage) deleteDescriptor(id uint32) error {
+	idx, d, err := f.findSlot(id)
+	if err != nil {
+		return err
+	}
+	d.Used = false
+	return f.writeDescriptorAt(idx, d)
+}
+
+// freeDataRegion zeroes the data region backing d. The container's data
+// region is append-only, so the space itself is not reclaimed, but its
+// contents are no longer readable.
+func (f *FileImage) freeDataRegion(d Descriptor) error {
+	if d.Filelen == 0 {
+		return nil
+	}
+	zero := make([]byte, d.Filelen)
+	if _, err := f.Fp.WriteAt(zero, d.Fileoff); err != nil {
+		return fmt.Errorf("while freeing data region: %w", err)
+	}
+	return nil
+}
+
+// writeExtraTrailer copies trailer into the fixed-size reservation at the
+// end of the Extra area of the descriptor identified by id (see
+// dedupTrailerLen).
+func (f *FileImage) writeExtraTrailer(id uint32, trailer []byte) error {
+	idx, d, err := f.findSlot(id)
+	if err != nil {
+		return err
+	}
+
+	base := len(d.Extra) - len(trailer)
+	copy(d.Extra[base:], trailer)
+
+	return f.writeDescriptorAt(idx, d)
+}
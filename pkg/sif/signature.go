@@ -0,0 +1,209 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnknownIdentity is returned by SignatureBackend.Verify when a signature
+// verifies cryptographically but the signing identity cannot be established.
+var ErrUnknownIdentity = errors.New("unknown signing identity")
+
+// Identity describes the party that produced a Signature, as established by
+// a SignatureBackend during verification.
+type Identity struct {
+	// Subject is the backend-specific identifier for the signer, e.g. a PGP
+	// user ID or a Fulcio certificate SAN.
+	Subject string
+
+	// Issuer identifies the authority that vouched for Subject, if any
+	// (empty for PGP, the OIDC issuer URL for sigstore).
+	Issuer string
+}
+
+// Signature is the backend-agnostic result of signing a payload. Backends
+// populate Raw with whatever bytes they need in order to later verify the
+// signature. Raw is stored as the signature descriptor's data object, not in
+// its Extra area, which holds only the SignatureHeader.
+type Signature struct {
+	// Format identifies the backend that produced this Signature, e.g.
+	// "pgp" or "sigstore".
+	Format string
+
+	// Raw holds the backend-specific encoded signature (an armored PGP
+	// signature packet, or a signed DSSE envelope plus certificate and Rekor
+	// inclusion proof, depending on Format).
+	Raw []byte
+}
+
+// SignatureBackend produces and verifies Signatures over arbitrary payloads.
+// Implementations are free to define what "verify" means (e.g. a PGP
+// keyring lookup, or an offline Fulcio/Rekor check) as long as Verify
+// returns a nil error only when it is confident in the returned Identity.
+type SignatureBackend interface {
+	// Sign returns a Signature over payload.
+	Sign(payload []byte) (Signature, error)
+
+	// Verify checks sig against payload and returns the identity of the
+	// signer.
+	Verify(payload []byte, sig Signature) (Identity, error)
+}
+
+// signatureOptions holds the configuration assembled from a set of
+// SignOption.
+type signatureOptions struct {
+	backend SignatureBackend
+}
+
+// SignOption configures a SignatureBackend choice. AddSignature and
+// VerifySignature take their SignatureBackend as an argument and do not
+// accept SignOption values.
+type SignOption func(*signatureOptions) error
+
+// OptSignatureBackend sets the SignatureBackend used to produce and verify
+// signatures. No default backend is applied when it is unset.
+func OptSignatureBackend(b SignatureBackend) SignOption {
+	return func(opts *signatureOptions) error {
+		opts.backend = b
+		return nil
+	}
+}
+
+// WithSignatureBackend is a DescriptorSelectorFunc that selects signature
+// descriptors produced by the named backend format (e.g. "pgp",
+// "sigstore").
+func WithSignatureBackend(format string) DescriptorSelectorFunc {
+	return func(d Descriptor) (bool, error) {
+		if d.Datatype != DataSignature {
+			return false, nil
+		}
+		var sh SignatureHeader
+		if err := sh.unmarshal(d); err != nil {
+			return false, err
+		}
+		return sh.format() == format, nil
+	}
+}
+
+// signatureFormatLen is the fixed size, in bytes, reserved for
+// SignatureHeader.Format. Extra is decoded with encoding/binary, which
+// requires fixed-size fields, so the backend name is stored the same way
+// Descriptor.Name and Partition.Arch are: as a NUL-padded byte array.
+const signatureFormatLen = 32
+
+// SignatureHeader is the backend-tagged payload stored in the Extra area of
+// a DataSignature descriptor, allowing readers to dispatch to the correct
+// SignatureBackend without parsing the signature bytes themselves.
+type SignatureHeader struct {
+	// Format names the SignatureBackend that produced the signature, e.g.
+	// "pgp" or "sigstore".
+	Format [signatureFormatLen]byte
+
+	// Hashtype is the hash algorithm applied to the signed payload prior to
+	// signing.
+	Hashtype Hashtype
+}
+
+func (sh *SignatureHeader) unmarshal(d Descriptor) error {
+	return unmarshalExtra(d, sh)
+}
+
+// format returns sh.Format as a string, trimmed of its NUL padding.
+func (sh *SignatureHeader) format() string {
+	return cstring(sh.Format[:])
+}
+
+// setFormat records format in sh.Format, truncating if necessary to fit.
+func (sh *SignatureHeader) setFormat(format string) {
+	copy(sh.Format[:], format)
+}
+
+// AddSignature signs the data object identified by id using b and appends a
+// DataSignature descriptor linked to it, with b's backend format and the
+// signature bytes recorded in the descriptor's data region.
+func (f *FileImage) AddSignature(id uint32, b SignatureBackend) error {
+	d, err := f.GetDescriptor(WithID(id))
+	if err != nil {
+		return fmt.Errorf("while locating descriptor %d: %w", id, err)
+	}
+
+	payload := io.NewSectionReader(f.Fp, d.Fileoff, d.Filelen)
+	h := sha256.New()
+	if _, err := io.Copy(h, payload); err != nil {
+		return fmt.Errorf("while hashing descriptor %d: %w", id, err)
+	}
+
+	sig, err := b.Sign(h.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("while signing descriptor %d: %w", id, err)
+	}
+
+	return f.addSignatureDescriptor(id, sig)
+}
+
+// VerifySignature verifies the signature descriptor identified by sigID
+// against the data object it is linked to, using b.
+func (f *FileImage) VerifySignature(sigID uint32, b SignatureBackend) (Identity, error) {
+	sigDescr, err := f.GetDescriptor(WithID(sigID))
+	if err != nil {
+		return Identity{}, fmt.Errorf("while locating signature %d: %w", sigID, err)
+	}
+
+	target, err := f.GetDescriptor(WithID(sigDescr.Link))
+	if err != nil {
+		return Identity{}, fmt.Errorf("while locating signed object for %d: %w", sigID, err)
+	}
+
+	payload := io.NewSectionReader(f.Fp, target.Fileoff, target.Filelen)
+	h := sha256.New()
+	if _, err := io.Copy(h, payload); err != nil {
+		return Identity{}, fmt.Errorf("while hashing descriptor %d: %w", target.GetID(), err)
+	}
+
+	var sh SignatureHeader
+	if err := sh.unmarshal(sigDescr); err != nil {
+		return Identity{}, err
+	}
+
+	sig := Signature{Format: sh.format(), Raw: f.signatureBytes(sigDescr)}
+
+	return b.Verify(h.Sum(nil), sig)
+}
+
+// addSignatureDescriptor appends a new DataSignature descriptor linked to
+// targetID, carrying sig's bytes as its data object and a SignatureHeader in
+// its Extra area.
+func (f *FileImage) addSignatureDescriptor(targetID uint32, sig Signature) error {
+	sh := SignatureHeader{Hashtype: HashSHA256}
+	sh.setFormat(sig.Format)
+
+	extra, err := marshalExtra(sh)
+	if err != nil {
+		return fmt.Errorf("while encoding signature header: %w", err)
+	}
+
+	d := Descriptor{
+		Datatype: DataSignature,
+		Used:     true,
+		Link:     targetID,
+		Extra:    extra,
+	}
+
+	_, err = f.appendDataObject(d, sig.Raw)
+	return err
+}
+
+// signatureBytes reads back the raw signature bytes stored in d's data
+// region.
+func (f *FileImage) signatureBytes(d Descriptor) []byte {
+	buf := make([]byte, d.Filelen)
+	_, _ = io.ReadFull(io.NewSectionReader(f.Fp, d.Fileoff, d.Filelen), buf)
+	return buf
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// pgpFormat is the SignatureHeader.Format value used by PGPBackend.
+const pgpFormat = "pgp"
+
+// PGPBackend is the original SignatureBackend implementation, producing and
+// verifying ASCII-armored OpenPGP signatures.
+type PGPBackend struct {
+	// Entity is used to sign payloads. May be nil for a verify-only
+	// backend.
+	Entity *openpgp.Entity
+
+	// KeyRing is consulted to verify signatures.
+	KeyRing openpgp.KeyRing
+}
+
+var _ SignatureBackend = (*PGPBackend)(nil)
+
+// Sign produces an armored OpenPGP detached signature over payload.
+func (b *PGPBackend) Sign(payload []byte) (Signature, error) {
+	if b.Entity == nil {
+		return Signature{}, fmt.Errorf("pgp backend has no signing entity")
+	}
+
+	buf := bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(&buf, b.Entity, bytes.NewReader(payload), nil); err != nil {
+		return Signature{}, fmt.Errorf("while generating pgp signature: %w", err)
+	}
+
+	return Signature{Format: pgpFormat, Raw: buf.Bytes()}, nil
+}
+
+// Verify checks an armored OpenPGP detached signature against payload using
+// b.KeyRing.
+func (b *PGPBackend) Verify(payload []byte, sig Signature) (Identity, error) {
+	if sig.Format != pgpFormat {
+		return Identity{}, fmt.Errorf("signature format %q is not %q", sig.Format, pgpFormat)
+	}
+	if b.KeyRing == nil {
+		return Identity{}, fmt.Errorf("pgp backend has no key ring")
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(b.KeyRing, bytes.NewReader(payload), bytes.NewReader(sig.Raw))
+	if err != nil {
+		return Identity{}, fmt.Errorf("while checking pgp signature: %w", err)
+	}
+	if signer == nil {
+		return Identity{}, ErrUnknownIdentity
+	}
+
+	var subject string
+	for _, id := range signer.Identities {
+		subject = id.Name
+		break
+	}
+
+	return Identity{Subject: subject}, nil
+}
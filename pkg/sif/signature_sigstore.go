@@ -0,0 +1,391 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// fulcioIssuerOID is the X.509 extension Fulcio embeds in every certificate
+// it issues, carrying the OIDC issuer URL the subject authenticated
+// against. See https://github.com/sigstore/fulcio, "OID information".
+var fulcioIssuerOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+
+// sigstoreFormat is the SignatureHeader.Format value used by
+// SigstoreBackend.
+const sigstoreFormat = "sigstore"
+
+// ErrRekorInclusionProof is returned by SigstoreBackend.Verify when the
+// stored Rekor inclusion proof does not check out against a checkpoint
+// signed by a trusted Rekor log key, or when the log entry it proves
+// inclusion for does not commit to the envelope and certificate being
+// verified.
+var ErrRekorInclusionProof = errors.New("rekor inclusion proof verification failed")
+
+// sigstoreEnvelope is the DSSE/in-toto envelope persisted as Signature.Raw
+// for a sigstore signature, bundled with the short-lived Fulcio certificate
+// and the Rekor transparency-log inclusion proof needed to verify it
+// offline.
+type sigstoreEnvelope struct {
+	// Envelope is the signed DSSE envelope bytes.
+	Envelope []byte `json:"envelope"`
+
+	// Certificate is the DER-encoded Fulcio-issued signing certificate.
+	Certificate []byte `json:"certificate"`
+
+	// RekorEntry is the opaque Rekor log entry, including its inclusion
+	// proof, as returned by the transparency log at signing time.
+	RekorEntry []byte `json:"rekorEntry"`
+}
+
+// SigstoreBackend is a keyless SignatureBackend: it signs by submitting the
+// payload to a Fulcio certificate authority and a Rekor transparency log,
+// and verifies offline by checking the resulting certificate chain and
+// inclusion proof without contacting either service.
+type SigstoreBackend struct {
+	// Signer performs the actual DSSE signing and certificate/log
+	// interactions. It is abstracted here so that tests, and alternative
+	// Fulcio/Rekor deployments, can supply their own implementation.
+	Signer SigstoreSigner
+
+	// Roots is the set of trusted Fulcio root certificates used to verify
+	// the certificate chain embedded in a signature.
+	Roots *x509.CertPool
+
+	// RekorPublicKey is the public key of the trusted Rekor transparency
+	// log. Verify rejects a signature unless its Rekor inclusion proof is
+	// backed by a checkpoint signed by this key: without that check, an
+	// attacker could supply a self-consistent but unattested Merkle tree
+	// of their own devising and "prove" inclusion for anything.
+	RekorPublicKey *ecdsa.PublicKey
+}
+
+// SigstoreSigner performs the keyless signing ceremony: obtaining a
+// short-lived certificate from Fulcio, signing payload, and recording the
+// result in Rekor.
+type SigstoreSigner interface {
+	SignAndLog(payload []byte) (envelope, cert, rekorEntry []byte, err error)
+}
+
+var _ SignatureBackend = (*SigstoreBackend)(nil)
+
+// Sign runs the keyless signing ceremony via b.Signer and bundles the
+// resulting DSSE envelope, certificate, and Rekor inclusion proof into a
+// Signature.
+func (b *SigstoreBackend) Sign(payload []byte) (Signature, error) {
+	if b.Signer == nil {
+		return Signature{}, fmt.Errorf("sigstore backend has no signer configured")
+	}
+
+	envelope, cert, rekorEntry, err := b.Signer.SignAndLog(payload)
+	if err != nil {
+		return Signature{}, fmt.Errorf("while performing keyless signing: %w", err)
+	}
+
+	raw, err := json.Marshal(sigstoreEnvelope{
+		Envelope:    envelope,
+		Certificate: cert,
+		RekorEntry:  rekorEntry,
+	})
+	if err != nil {
+		return Signature{}, fmt.Errorf("while encoding sigstore envelope: %w", err)
+	}
+
+	return Signature{Format: sigstoreFormat, Raw: raw}, nil
+}
+
+// Verify checks the Fulcio certificate chain against b.Roots and the Rekor
+// inclusion proof offline, then verifies the DSSE envelope signature using
+// the certificate's public key.
+func (b *SigstoreBackend) Verify(payload []byte, sig Signature) (Identity, error) {
+	if sig.Format != sigstoreFormat {
+		return Identity{}, fmt.Errorf("signature format %q is not %q", sig.Format, sigstoreFormat)
+	}
+
+	var env sigstoreEnvelope
+	if err := json.Unmarshal(sig.Raw, &env); err != nil {
+		return Identity{}, fmt.Errorf("while decoding sigstore envelope: %w", err)
+	}
+
+	cert, err := parseCertificate(env.Certificate)
+	if err != nil {
+		return Identity{}, fmt.Errorf("while parsing signing certificate: %w", err)
+	}
+
+	integratedTime, err := verifyRekorInclusion(env.RekorEntry, env.Envelope, cert.Raw, b.RekorPublicKey)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %s", ErrRekorInclusionProof, err)
+	}
+
+	// Fulcio certificates are short-lived (around ten minutes), so they are
+	// almost always expired by the time a signature is verified. Trust is
+	// instead anchored at the moment Rekor attested the signing event, not
+	// the wall clock.
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:       b.Roots,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		CurrentTime: integratedTime,
+	}); err != nil {
+		return Identity{}, fmt.Errorf("while verifying certificate chain: %w", err)
+	}
+
+	if err := verifyDSSEEnvelope(env.Envelope, payload, cert); err != nil {
+		return Identity{}, fmt.Errorf("while verifying envelope signature: %w", err)
+	}
+
+	return identityFromCertificate(cert), nil
+}
+
+func parseCertificate(derBytes []byte) (*x509.Certificate, error) {
+	return x509.ParseCertificate(derBytes)
+}
+
+// dsseEnvelope mirrors the subset of the DSSE (Dead Simple Signing
+// Envelope) format this backend relies on.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     []byte `json:"payload"`
+	Signatures  []struct {
+		Sig []byte `json:"sig"`
+	} `json:"signatures"`
+}
+
+// verifyDSSEEnvelope checks that envelope wraps payload and carries a valid
+// ECDSA signature from cert's public key over the DSSE pre-authentication
+// encoding.
+func verifyDSSEEnvelope(envelope, payload []byte, cert *x509.Certificate) error {
+	var env dsseEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return fmt.Errorf("while decoding envelope: %w", err)
+	}
+
+	if len(env.Signatures) == 0 {
+		return errors.New("envelope carries no signatures")
+	}
+	if string(env.Payload) != string(payload) {
+		return errors.New("envelope payload does not match signed content")
+	}
+
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported certificate public key type %T", cert.PublicKey)
+	}
+
+	digest := sha256.Sum256(pae(env.PayloadType, env.Payload))
+	if !ecdsa.VerifyASN1(pub, digest[:], env.Signatures[0].Sig) {
+		return errors.New("signature does not verify against certificate public key")
+	}
+
+	return nil
+}
+
+// pae computes the DSSE pre-authentication encoding of a payload type and
+// body.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// rekorInclusionProof is the RFC6962 Merkle audit path for a Rekor log
+// entry, as returned alongside the entry itself at signing time.
+type rekorInclusionProof struct {
+	LogIndex int64    `json:"logIndex"`
+	RootHash string   `json:"rootHash"` // hex-encoded signed tree head root
+	TreeSize int64    `json:"treeSize"`
+	Hashes   []string `json:"hashes"` // hex-encoded audit path, leaf to root
+
+	// CheckpointSignature is an ECDSA signature, by the Rekor log's own
+	// key, over the checkpoint (TreeSize, RootHash) pair. Without it,
+	// RootHash is just a value the entry's own author supplied, and the
+	// inclusion proof "verifies" against whatever that author chose.
+	CheckpointSignature []byte `json:"checkpointSignature"`
+}
+
+// rekorLogEntry is the subset of a Rekor log entry needed to verify, offline,
+// that it was included in the log at the claimed time.
+type rekorLogEntry struct {
+	Body           []byte              `json:"body"`
+	IntegratedTime int64               `json:"integratedTime"`
+	InclusionProof rekorInclusionProof `json:"inclusionProof"`
+}
+
+// rekorEntryBody is the canonical content of a Rekor log entry's Body for a
+// sigstore signature recorded by this package: digests binding the entry to
+// the exact DSSE envelope and Fulcio certificate it attests to, so that a
+// valid inclusion proof for one envelope/certificate pair cannot be replayed
+// against another.
+type rekorEntryBody struct {
+	EnvelopeSHA256    string `json:"envelopeSha256"`
+	CertificateSHA256 string `json:"certificateSha256"`
+}
+
+// verifyRekorInclusion checks that rekorEntry is a valid RFC6962 Merkle
+// inclusion proof, backed by a checkpoint signed by rekorPub, for a log
+// entry whose body commits to envelope and certDER. It returns the time the
+// log attested to the entry's inclusion.
+func verifyRekorInclusion(rekorEntry, envelope, certDER []byte, rekorPub *ecdsa.PublicKey) (time.Time, error) {
+	if rekorPub == nil {
+		return time.Time{}, errors.New("no trusted rekor public key configured")
+	}
+
+	var entry rekorLogEntry
+	if err := json.Unmarshal(rekorEntry, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("while decoding rekor entry: %w", err)
+	}
+	if len(entry.Body) == 0 {
+		return time.Time{}, errors.New("rekor entry is missing a body")
+	}
+
+	var body rekorEntryBody
+	if err := json.Unmarshal(entry.Body, &body); err != nil {
+		return time.Time{}, fmt.Errorf("while decoding rekor entry body: %w", err)
+	}
+
+	envelopeDigest := sha256.Sum256(envelope)
+	if body.EnvelopeSHA256 != hex.EncodeToString(envelopeDigest[:]) {
+		return time.Time{}, errors.New("rekor entry does not commit to the signed envelope")
+	}
+	certDigest := sha256.Sum256(certDER)
+	if body.CertificateSHA256 != hex.EncodeToString(certDigest[:]) {
+		return time.Time{}, errors.New("rekor entry does not commit to the signing certificate")
+	}
+
+	root, err := hex.DecodeString(entry.InclusionProof.RootHash)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("while decoding root hash: %w", err)
+	}
+
+	if err := verifyCheckpointSignature(entry.InclusionProof.TreeSize, root, entry.InclusionProof.CheckpointSignature, rekorPub); err != nil {
+		return time.Time{}, fmt.Errorf("while verifying checkpoint signature: %w", err)
+	}
+
+	proof := make([][]byte, len(entry.InclusionProof.Hashes))
+	for i, h := range entry.InclusionProof.Hashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("while decoding inclusion path entry %d: %w", i, err)
+		}
+		proof[i] = b
+	}
+
+	leaf := rekorLeafHash(entry.Body)
+
+	got, err := rekorRootFromInclusionProof(entry.InclusionProof.LogIndex, entry.InclusionProof.TreeSize, leaf, proof)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !bytes.Equal(got, root) {
+		return time.Time{}, errors.New("computed root does not match signed checkpoint")
+	}
+
+	return time.Unix(entry.IntegratedTime, 0), nil
+}
+
+// checkpointBytes is the canonical byte encoding of a Rekor checkpoint
+// (a signed tree head) over which CheckpointSignature is computed.
+func checkpointBytes(treeSize int64, rootHash []byte) []byte {
+	return []byte(fmt.Sprintf("rekor checkpoint\nsize %d\nhash %s\n", treeSize, hex.EncodeToString(rootHash)))
+}
+
+// verifyCheckpointSignature checks that sig is a valid ECDSA signature by
+// pub over the checkpoint committing the log to rootHash at treeSize.
+func verifyCheckpointSignature(treeSize int64, rootHash, sig []byte, pub *ecdsa.PublicKey) error {
+	if len(sig) == 0 {
+		return errors.New("checkpoint is missing a signature")
+	}
+
+	digest := sha256.Sum256(checkpointBytes(treeSize, rootHash))
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return errors.New("signature does not verify against rekor public key")
+	}
+
+	return nil
+}
+
+// rekorLeafHash computes the RFC6962 leaf hash of a Rekor log entry body.
+func rekorLeafHash(body []byte) []byte {
+	h := sha256.Sum256(append([]byte{0x00}, body...))
+	return h[:]
+}
+
+// rekorNodeHash computes the RFC6962 interior node hash of a left and right
+// child.
+func rekorNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// rekorRootFromInclusionProof recomputes the Merkle tree root implied by
+// leafHash at leafIndex in a tree of treeSize leaves, folding in the audit
+// path proof bottom-up per RFC6962.
+func rekorRootFromInclusionProof(leafIndex, treeSize int64, leafHash []byte, proof [][]byte) ([]byte, error) {
+	if leafIndex < 0 || treeSize <= 0 || leafIndex >= treeSize {
+		return nil, fmt.Errorf("invalid leaf index %d for tree size %d", leafIndex, treeSize)
+	}
+
+	fn, sn := leafIndex, treeSize-1
+	r := leafHash
+
+	for _, h := range proof {
+		if sn == 0 {
+			return nil, errors.New("inclusion proof longer than expected for tree size")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = rekorNodeHash(h, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = rekorNodeHash(r, h)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errors.New("inclusion proof shorter than expected for tree size")
+	}
+
+	return r, nil
+}
+
+// identityFromCertificate extracts the keyless signer's identity from the
+// SAN and Fulcio OIDC issuer extensions of a Fulcio-issued certificate.
+func identityFromCertificate(cert *x509.Certificate) Identity {
+	id := Identity{Issuer: issuerFromCertificate(cert)}
+	if len(cert.EmailAddresses) > 0 {
+		id.Subject = cert.EmailAddresses[0]
+	} else if len(cert.URIs) > 0 {
+		id.Subject = cert.URIs[0].String()
+	}
+	return id
+}
+
+// issuerFromCertificate extracts the OIDC issuer URL Fulcio embeds in cert's
+// fulcioIssuerOID extension. The cert's own Issuer DN identifies the Fulcio
+// CA that signed it, not the OIDC identity provider the subject
+// authenticated against, so it cannot be used for this.
+func issuerFromCertificate(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// buildMerkleFixture returns the RFC6962 root hash and inclusion proof for
+// leafIndex within a four-leaf tree built from the given bodies.
+func buildMerkleFixture(t *testing.T, bodies [4][]byte, leafIndex int) (root []byte, proof [][]byte) {
+	t.Helper()
+
+	h := make([][]byte, 4)
+	for i, b := range bodies {
+		h[i] = rekorLeafHash(b)
+	}
+
+	node01 := rekorNodeHash(h[0], h[1])
+	node23 := rekorNodeHash(h[2], h[3])
+	root = rekorNodeHash(node01, node23)
+
+	switch leafIndex {
+	case 0:
+		proof = [][]byte{h[1], node23}
+	case 1:
+		proof = [][]byte{h[0], node23}
+	case 2:
+		proof = [][]byte{h[3], node01}
+	case 3:
+		proof = [][]byte{h[2], node01}
+	default:
+		t.Fatalf("unsupported leaf index %d", leafIndex)
+	}
+
+	return root, proof
+}
+
+func TestRekorRootFromInclusionProof(t *testing.T) {
+	bodies := [4][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+
+	for leafIndex := 0; leafIndex < 4; leafIndex++ {
+		root, proof := buildMerkleFixture(t, bodies, leafIndex)
+
+		got, err := rekorRootFromInclusionProof(int64(leafIndex), 4, rekorLeafHash(bodies[leafIndex]), proof)
+		if err != nil {
+			t.Fatalf("leaf %d: %v", leafIndex, err)
+		}
+		if hex.EncodeToString(got) != hex.EncodeToString(root) {
+			t.Errorf("leaf %d: got root %x, want %x", leafIndex, got, root)
+		}
+	}
+}
+
+// signCheckpoint signs the checkpoint committing to (treeSize, root) with
+// rekorKey, as a Rekor log would before returning an inclusion proof.
+func signCheckpoint(t *testing.T, rekorKey *ecdsa.PrivateKey, treeSize int64, root []byte) []byte {
+	t.Helper()
+
+	digest := sha256.Sum256(checkpointBytes(treeSize, root))
+	sig, err := ecdsa.SignASN1(rand.Reader, rekorKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestVerifyRekorInclusion(t *testing.T) {
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope := []byte("test dsse envelope")
+	certDER := []byte("test certificate DER")
+	envelopeDigest := sha256.Sum256(envelope)
+	certDigest := sha256.Sum256(certDER)
+
+	body, err := json.Marshal(rekorEntryBody{
+		EnvelopeSHA256:    hex.EncodeToString(envelopeDigest[:]),
+		CertificateSHA256: hex.EncodeToString(certDigest[:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := [4][]byte{[]byte("a"), []byte("b"), body, []byte("d")}
+	root, proof := buildMerkleFixture(t, bodies, 2)
+
+	hashes := make([]string, len(proof))
+	for i, p := range proof {
+		hashes[i] = hex.EncodeToString(p)
+	}
+
+	entry := rekorLogEntry{
+		Body:           bodies[2],
+		IntegratedTime: 1700000000,
+		InclusionProof: rekorInclusionProof{
+			LogIndex:            2,
+			RootHash:            hex.EncodeToString(root),
+			TreeSize:            4,
+			Hashes:              hashes,
+			CheckpointSignature: signCheckpoint(t, rekorKey, 4, root),
+		},
+	}
+	rekorEntry, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := verifyRekorInclusion(rekorEntry, envelope, certDER, &rekorKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Unix() != entry.IntegratedTime {
+		t.Errorf("got integrated time %v, want %v", got.Unix(), entry.IntegratedTime)
+	}
+
+	if _, err := verifyRekorInclusion(rekorEntry, []byte("a different envelope"), certDER, &rekorKey.PublicKey); err == nil {
+		t.Error("expected an error verifying an entry bound to a different envelope")
+	}
+
+	if _, err := verifyRekorInclusion(rekorEntry, envelope, certDER, nil); err == nil {
+		t.Error("expected an error verifying without a trusted rekor public key")
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyRekorInclusion(rekorEntry, envelope, certDER, &otherKey.PublicKey); err == nil {
+		t.Error("expected an error verifying against an untrusted rekor public key")
+	}
+
+	entry.InclusionProof.RootHash = hex.EncodeToString(rekorLeafHash([]byte("tampered")))
+	tamperedEntry, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyRekorInclusion(tamperedEntry, envelope, certDER, &rekorKey.PublicKey); err == nil {
+		t.Error("expected an error verifying a tampered root hash")
+	}
+}
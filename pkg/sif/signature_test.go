@@ -0,0 +1,217 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sif
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestFileImage_PGPSignAndVerify(t *testing.T) {
+	f := newTestImage(t)
+
+	id, err := f.appendDataObject(Descriptor{Datatype: DataGeneric, Used: true}, []byte("payload to sign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &PGPBackend{Entity: entity, KeyRing: openpgp.EntityList{entity}}
+
+	if err := f.AddSignature(id, backend); err != nil {
+		t.Fatal(err)
+	}
+
+	sigDescr, err := f.GetDescriptor(WithDataType(DataSignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := f.VerifySignature(sigDescr.GetID(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := identity.Subject, "Test Signer <signer@example.com>"; got != want {
+		t.Errorf("got subject %q, want %q", got, want)
+	}
+}
+
+// testSigstoreSigner is a minimal SigstoreSigner that issues a real
+// Fulcio-style certificate and Rekor inclusion proof, entirely offline, for
+// exercising SigstoreBackend end to end.
+type testSigstoreSigner struct {
+	key            *ecdsa.PrivateKey
+	leaf           []byte
+	integratedTime time.Time
+	rekorKey       *ecdsa.PrivateKey
+}
+
+func (s *testSigstoreSigner) SignAndLog(payload []byte) (envelope, cert, rekorEntry []byte, err error) {
+	const payloadType = "application/vnd.in-toto+json"
+
+	digest := sha256.Sum256(pae(payloadType, payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	envelope, err = json.Marshal(struct {
+		PayloadType string `json:"payloadType"`
+		Payload     []byte `json:"payload"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	}{
+		PayloadType: payloadType,
+		Payload:     payload,
+		Signatures: []struct {
+			Sig []byte `json:"sig"`
+		}{{Sig: sig}},
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	envelopeDigest := sha256.Sum256(envelope)
+	certDigest := sha256.Sum256(s.leaf)
+	body, err := json.Marshal(rekorEntryBody{
+		EnvelopeSHA256:    hex.EncodeToString(envelopeDigest[:]),
+		CertificateSHA256: hex.EncodeToString(certDigest[:]),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	leafHash := rekorLeafHash(body)
+
+	checkpointDigest := sha256.Sum256(checkpointBytes(1, leafHash))
+	checkpointSig, err := ecdsa.SignASN1(rand.Reader, s.rekorKey, checkpointDigest[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rekorEntry, err = json.Marshal(rekorLogEntry{
+		Body:           body,
+		IntegratedTime: s.integratedTime.Unix(),
+		InclusionProof: rekorInclusionProof{
+			LogIndex:            0,
+			RootHash:            hex.EncodeToString(leafHash),
+			TreeSize:            1,
+			CheckpointSignature: checkpointSig,
+		},
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return envelope, s.leaf, rekorEntry, nil
+}
+
+func TestFileImage_SigstoreSignAndVerify(t *testing.T) {
+	integratedTime := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sylabs-test-ca"},
+		NotBefore:             integratedTime.Add(-24 * time.Hour),
+		NotAfter:              integratedTime.Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wantIssuer = "https://accounts.example.com"
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "sigstore-leaf"},
+		NotBefore:      integratedTime.Add(-5 * time.Minute),
+		NotAfter:       integratedTime.Add(5 * time.Minute),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{"signer@example.com"},
+		ExtraExtensions: []pkix.Extension{
+			{Id: fulcioIssuerOID, Value: []byte(wantIssuer)},
+		},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	backend := &SigstoreBackend{
+		Signer:         &testSigstoreSigner{key: leafKey, leaf: leafDER, integratedTime: integratedTime, rekorKey: rekorKey},
+		Roots:          roots,
+		RekorPublicKey: &rekorKey.PublicKey,
+	}
+
+	f := newTestImage(t)
+
+	id, err := f.appendDataObject(Descriptor{Datatype: DataGeneric, Used: true}, []byte("payload to sign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.AddSignature(id, backend); err != nil {
+		t.Fatal(err)
+	}
+
+	sigDescr, err := f.GetDescriptor(WithDataType(DataSignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := f.VerifySignature(sigDescr.GetID(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := identity.Subject, "signer@example.com"; got != want {
+		t.Errorf("got subject %q, want %q", got, want)
+	}
+	if got, want := identity.Issuer, wantIssuer; got != want {
+		t.Errorf("got issuer %q, want %q", got, want)
+	}
+}
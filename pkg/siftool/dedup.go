@@ -0,0 +1,106 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package siftool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+// Dedup implements 'siftool dedup' sub-command
+func Dedup() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dedup <containerfile>",
+		Short: "Rewrite a SIF file, deduplicating identical data objects",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fimg, err := sif.LoadContainer(args[0], false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			return dedupContainer(&fimg)
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+// dedupContainer scans every descriptor in fimg by content digest. The
+// first descriptor seen for a given digest is left untouched and marked as
+// that content's owner; every later descriptor with the same digest is
+// rewritten in place to reference the owner's data region instead of
+// carrying its own redundant copy. Overlay partitions are left untouched
+// entirely: they are explicitly mutable runtime scratch space, so aliasing
+// their data region (even when two happen to have identical content, e.g.
+// freshly created and still all-zero) would let a write to one silently
+// corrupt the other. Encrypted partitions are left untouched too: their
+// CryptKey extra metadata isn't eligible for the dedup trailer (see
+// sif.ErrEncryptedNotDedupEligible).
+func dedupContainer(fimg *sif.FileImage) error {
+	ds, err := fimg.GetDescriptors()
+	if err != nil {
+		return fmt.Errorf("while listing data objects: %w", err)
+	}
+
+	isOverlay := sif.WithOverlayPartitions()
+	isEncrypted := sif.WithEncryptedPartitions()
+
+	owners := map[string]uint32{}
+
+	for _, d := range ds {
+		overlay, err := isOverlay(d)
+		if err != nil {
+			return fmt.Errorf("while checking descriptor %d: %w", d.GetID(), err)
+		}
+		encrypted, err := isEncrypted(d)
+		if err != nil {
+			return fmt.Errorf("while checking descriptor %d: %w", d.GetID(), err)
+		}
+		if overlay || encrypted {
+			continue
+		}
+
+		digest, err := contentDigest(fimg, d)
+		if err != nil {
+			return fmt.Errorf("while hashing descriptor %d: %w", d.GetID(), err)
+		}
+
+		ownerID, isDuplicate := owners[digest]
+		if !isDuplicate {
+			if _, err := fimg.MarkDedupOwner(d.GetID()); err != nil {
+				return fmt.Errorf("while registering descriptor %d: %w", d.GetID(), err)
+			}
+			owners[digest] = d.GetID()
+			continue
+		}
+
+		if err := fimg.RewriteAsDuplicate(d.GetID(), ownerID); err != nil {
+			return fmt.Errorf("while deduplicating descriptor %d: %w", d.GetID(), err)
+		}
+	}
+
+	return nil
+}
+
+// contentDigest returns the hex-encoded SHA-256 digest of d's data region.
+func contentDigest(fimg *sif.FileImage, d sif.Descriptor) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(fimg.Fp, d.Fileoff, d.Filelen)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
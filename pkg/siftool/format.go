@@ -0,0 +1,76 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package siftool
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sylabs/sif/pkg/sif"
+	"gopkg.in/yaml.v3"
+)
+
+// descrFormatter renders a descriptor's info as a string.
+type descrFormatter func(fimg *sif.FileImage, id uint32) (string, error)
+
+// descrFormatters maps a --format flag value to the formatter that
+// implements it.
+var descrFormatters = map[string]descrFormatter{
+	"text": formatText,
+	"json": formatJSON,
+	"yaml": formatYAML,
+}
+
+func formatText(fimg *sif.FileImage, id uint32) (string, error) {
+	return fimg.FmtDescrInfo(id), nil
+}
+
+func formatJSON(fimg *sif.FileImage, id uint32) (string, error) {
+	d, err := fimg.GetDescriptor(sif.WithID(id))
+	if err != nil {
+		return "", err
+	}
+
+	info, err := d.GetInfo()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(b) + "\n", nil
+}
+
+func formatYAML(fimg *sif.FileImage, id uint32) (string, error) {
+	d, err := fimg.GetDescriptor(sif.WithID(id))
+	if err != nil {
+		return "", err
+	}
+
+	info, err := d.GetInfo()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := yaml.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// resolveFormatter looks up the descrFormatter registered for name.
+func resolveFormatter(name string) (descrFormatter, error) {
+	f, ok := descrFormatters[name]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized output format %q", name)
+	}
+	return f, nil
+}
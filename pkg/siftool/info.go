@@ -18,7 +18,9 @@ import (
 
 // Info implements 'siftool info' sub-command
 func Info() *cobra.Command {
-	return &cobra.Command{
+	var format string
+
+	cmd := &cobra.Command{
 		Use:   "info <descriptorid> <containerfile>",
 		Short: "Display detailed information of object descriptors",
 		Args:  cobra.ExactArgs(2),
@@ -29,6 +31,11 @@ func Info() *cobra.Command {
 				return fmt.Errorf("while converting input descriptor id: %s", err)
 			}
 
+			formatter, err := resolveFormatter(format)
+			if err != nil {
+				return err
+			}
+
 			fimg, err := sif.LoadContainer(args[1], true)
 			if err != nil {
 				return err
@@ -39,10 +46,19 @@ func Info() *cobra.Command {
 				}
 			}()
 
-			fmt.Print(fimg.FmtDescrInfo(uint32(id)))
+			out, err := formatter(&fimg, uint32(id))
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(out)
 
 			return nil
 		},
 		DisableFlagsInUseLine: true,
 	}
+
+	cmd.Flags().StringVar(&format, "format", "text", "output format (text, json, yaml)")
+
+	return cmd
 }
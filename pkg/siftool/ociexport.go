@@ -0,0 +1,42 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package siftool
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/sif/pkg/sif/oci"
+)
+
+// OciExport implements 'siftool oci-export' sub-command
+func OciExport() *cobra.Command {
+	return &cobra.Command{
+		Use:   "oci-export <containerfile> <directory>",
+		Short: "Convert a SIF file into an OCI image layout",
+		Args:  cobra.ExactArgs(2),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fimg, err := sif.LoadContainer(args[0], true)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			if err := oci.ToOCILayout(&fimg, args[1]); err != nil {
+				return fmt.Errorf("while converting to OCI layout: %w", err)
+			}
+
+			return nil
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package siftool
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+// Overlay implements 'siftool overlay' command group
+func Overlay() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                   "overlay",
+		Short:                 "Manage overlay partitions",
+		DisableFlagsInUseLine: true,
+	}
+
+	cmd.AddCommand(overlayAdd())
+	cmd.AddCommand(overlayResize())
+	cmd.AddCommand(overlaySeal())
+	cmd.AddCommand(overlayList())
+
+	return cmd
+}
+
+func overlayAdd() *cobra.Command {
+	var fsType string
+
+	cmd := &cobra.Command{
+		Use:   "add <size> <containerfile>",
+		Short: "Add an overlay partition",
+		Args:  cobra.ExactArgs(2),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("while converting input size: %s", err)
+			}
+
+			fimg, err := sif.LoadContainer(args[1], false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			fs, err := parseFsType(fsType)
+			if err != nil {
+				return err
+			}
+
+			id, err := fimg.AddOverlay(size, fs)
+			if err != nil {
+				return fmt.Errorf("while adding overlay partition: %w", err)
+			}
+
+			fmt.Printf("Added overlay partition with ID %d\n", id)
+
+			return nil
+		},
+		DisableFlagsInUseLine: true,
+	}
+
+	cmd.Flags().StringVar(&fsType, "fs", "squashfs", "filesystem type for the new overlay (squashfs or ext3)")
+
+	return cmd
+}
+
+func overlayResize() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resize <descriptorid> <newsize> <containerfile>",
+		Short: "Resize an overlay partition",
+		Args:  cobra.ExactArgs(3),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return fmt.Errorf("while converting input descriptor id: %s", err)
+			}
+
+			newSize, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("while converting input size: %s", err)
+			}
+
+			fimg, err := sif.LoadContainer(args[2], false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			return fimg.ResizeOverlay(uint32(id), newSize)
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+func overlaySeal() *cobra.Command {
+	return &cobra.Command{
+		Use:   "seal <descriptorid> <containerfile>",
+		Short: "Seal an overlay partition, preventing further resizing",
+		Args:  cobra.ExactArgs(2),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return fmt.Errorf("while converting input descriptor id: %s", err)
+			}
+
+			fimg, err := sif.LoadContainer(args[1], false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			return fimg.SealOverlay(uint32(id))
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+func overlayList() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list <containerfile>",
+		Short: "List overlay partitions",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fimg, err := sif.LoadContainer(args[0], true)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			ds, err := fimg.GetDescriptors(sif.WithOverlayPartitions())
+			if err != nil {
+				return fmt.Errorf("while listing overlay partitions: %w", err)
+			}
+
+			for _, d := range ds {
+				fmt.Printf("%d\n", d.GetID())
+			}
+
+			return nil
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+func parseFsType(s string) (sif.FsType, error) {
+	switch s {
+	case "squashfs":
+		return sif.FsSquash, nil
+	case "ext3":
+		return sif.FsExt3, nil
+	default:
+		return 0, fmt.Errorf("unrecognized filesystem type %q", s)
+	}
+}
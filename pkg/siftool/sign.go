@@ -0,0 +1,110 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package siftool
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/sylabs/sif/pkg/sif"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Sign implements 'siftool sign' sub-command
+func Sign() *cobra.Command {
+	var backend string
+	var keyPath string
+
+	cmd := &cobra.Command{
+		Use:   "sign <containerfile>",
+		Short: "Sign a SIF file",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			b, err := signatureBackend(backend, keyPath)
+			if err != nil {
+				return err
+			}
+
+			fimg, err := sif.LoadContainer(args[0], false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := fimg.UnloadContainer(); err != nil {
+					fmt.Println("Error unloading container: ", err)
+				}
+			}()
+
+			return signContainer(&fimg, b)
+		},
+		DisableFlagsInUseLine: true,
+	}
+
+	cmd.Flags().StringVar(&backend, "backend", "pgp", "signature backend to use (pgp)")
+	cmd.Flags().StringVar(&keyPath, "key", "", "path to an ASCII-armored PGP private key (required for the pgp backend)")
+
+	return cmd
+}
+
+// signatureBackend resolves the --backend and --key flag values into a
+// sif.SignatureBackend.
+func signatureBackend(name, keyPath string) (sif.SignatureBackend, error) {
+	switch name {
+	case "pgp":
+		return pgpBackendFromKey(keyPath)
+	default:
+		// sif.SigstoreBackend is not offered here: it performs a keyless
+		// signing ceremony against a Fulcio certificate authority and Rekor
+		// transparency log via a caller-supplied sif.SigstoreSigner, and
+		// siftool does not itself implement a Fulcio/Rekor client to provide
+		// one. Callers who need it can embed sif.SigstoreBackend directly.
+		return nil, fmt.Errorf("unrecognized signature backend %q", name)
+	}
+}
+
+// pgpBackendFromKey reads the ASCII-armored private key at path and returns a
+// PGPBackend configured to sign with it.
+func pgpBackendFromKey(path string) (*sif.PGPBackend, error) {
+	if path == "" {
+		return nil, fmt.Errorf("pgp backend requires --key")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening private key %q: %w", path, err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading private key %q: %w", path, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("private key %q contains no entities", path)
+	}
+
+	return &sif.PGPBackend{Entity: entities[0]}, nil
+}
+
+// signContainer signs every partition in fimg using b, appending a
+// DataSignature descriptor for each. A partition that is already signed
+// gets an additional signature.
+func signContainer(fimg *sif.FileImage, b sif.SignatureBackend) error {
+	descrs, err := fimg.GetDescriptors(sif.WithDataType(sif.DataPartition))
+	if err != nil {
+		return fmt.Errorf("while selecting partitions to sign: %w", err)
+	}
+
+	for _, d := range descrs {
+		if err := fimg.AddSignature(d.GetID(), b); err != nil {
+			return fmt.Errorf("while signing descriptor %d: %w", d.GetID(), err)
+		}
+	}
+
+	return nil
+}